@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+	"vimagination.zapto.org/webserver/proxy"
+)
+
+// ACME configures the proxy to manage certificates for sites, in a single
+// cache, answering HTTP-01 challenges itself.
+//
+// Certificates are only managed for the aliases of sites that the proxy
+// terminates TLS for, as other sites are passed the encrypted connection and
+// must present their own certificates. Those sites keep managing their own
+// certificates, with their challenges being passed on to them.
+type ACME struct {
+	// Email is the contact address given to the ACME server
+	Email string
+	// CacheDir is where the account key and certificates are stored
+	CacheDir string
+	// DirectoryURL is the ACME directory, defaulting to Let's Encrypt
+	DirectoryURL string
+}
+
+// certManager provides certificates for the sites that the proxy terminates
+// TLS for, using configured certificates before falling back to ACME.
+//
+// Each site is only given certificates for its own aliases, so that a site
+// cannot be made to present the certificate of another.
+type certManager struct {
+	acme *autocert.Manager
+
+	mu    sync.RWMutex
+	certs map[string]*proxy.Certificates
+	names map[string]string
+}
+
+func newCertManager(config *ACME) *certManager {
+	c := &certManager{
+		certs: make(map[string]*proxy.Certificates),
+		names: make(map[string]string),
+	}
+	if config != nil {
+		cacheDir := config.CacheDir
+		if cacheDir == "" {
+			cacheDir = "./certcache/"
+		}
+		c.acme = &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			Cache:      autocert.DirCache(cacheDir),
+			HostPolicy: c.hostPolicy,
+			Email:      config.Email,
+		}
+		if config.DirectoryURL != "" {
+			c.acme.Client = &acme.Client{
+				DirectoryURL: config.DirectoryURL,
+			}
+		}
+	}
+	return c
+}
+
+// update loads the certificates for the sites that the proxy terminates TLS
+// for, and registers all of their other exact aliases for ACME, recording
+// which site each belongs to.
+//
+// HTTPS connections are routed by hostname alone, so aliases with a path are
+// not registered.
+//
+// The current certificates are only replaced if all can be loaded.
+func (c *certManager) update(sites []Site) error {
+	certs := make(map[string]*proxy.Certificates)
+	names := make(map[string]string)
+	for _, site := range sites {
+		if !site.TerminateTLS {
+			continue
+		}
+		siteCerts := proxy.NewCertificates()
+		for alias, cert := range site.Certificates {
+			if err := siteCerts.Load(alias, cert.CertFile, cert.KeyFile); err != nil {
+				return fmt.Errorf("error loading certificate for %q: %w", alias, err)
+			}
+		}
+		certs[site.Name] = siteCerts
+		for _, alias := range site.Aliases {
+			if _, ok := site.Certificates[alias]; ok || !isHostname(alias) {
+				continue
+			}
+			names[alias] = site.Name
+		}
+	}
+	c.mu.Lock()
+	c.certs = certs
+	c.names = names
+	c.mu.Unlock()
+	return nil
+}
+
+func isHostname(alias string) bool {
+	for _, r := range alias {
+		if r == '*' || r == '/' {
+			return false
+		}
+	}
+	return alias != "" && alias[0] != '.'
+}
+
+// hostPolicy allows ACME certificates for the registered names.
+//
+// The HTTP-01 challenge handler checks the Host header of the request against
+// the policy, so any port is removed, as it is when routing.
+func (c *certManager) hostPolicy(_ context.Context, host string) error {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	c.mu.RLock()
+	_, ok := c.names[host]
+	c.mu.RUnlock()
+	if !ok {
+		return ErrUnknownHost
+	}
+	return nil
+}
+
+// getCertificate returns a certificate for the named site, either one
+// configured for it or, when the server name is one of its aliases, one from
+// ACME
+func (c *certManager) getCertificate(site string, hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	certs := c.certs[site]
+	owner, ok := c.names[strings.ToLower(hello.ServerName)]
+	c.mu.RUnlock()
+	if certs != nil {
+		if cert, err := certs.GetCertificate(hello); err == nil {
+			return cert, nil
+		}
+	}
+	if c.acme == nil || !ok || owner != site {
+		return nil, proxy.ErrNoCertificate
+	}
+	return c.acme.GetCertificate(hello)
+}
+
+// tlsConfig returns the configuration used to terminate TLS for the named site
+func (c *certManager) tlsConfig(site string) *tls.Config {
+	config := &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return c.getCertificate(site, hello)
+		},
+		NextProtos: []string{"http/1.1"},
+	}
+	if c.acme != nil {
+		config.NextProtos = append(config.NextProtos, acme.ALPNProto)
+	}
+	return config
+}
+
+// challengeHandler returns the handler for HTTP-01 challenges, or nil if ACME
+// is not configured
+func (c *certManager) challengeHandler() http.Handler {
+	if c.acme == nil {
+		return nil
+	}
+	return c.acme.HTTPHandler(http.NotFoundHandler())
+}
+
+// Errors
+var (
+	ErrUnknownHost = errors.New("host not configured for ACME")
+)
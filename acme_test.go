@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"vimagination.zapto.org/webserver/proxy"
+)
+
+// The ACME issuance test runs against a local pebble server, which needs a
+// DNS server that resolves all names to the loopback address, such as the
+// pebble-challtestsrv with its own challenge servers disabled:
+//
+//	pebble-challtestsrv -http01 "" -https01 "" -tlsalpn01 "" -doh "" &
+//	PEBBLE_VA_NOSLEEP=1 pebble -config test/config/pebble-config.json -dnsserver 127.0.0.1:8053 &
+//	PEBBLE_DIRECTORY=https://127.0.0.1:14000/dir go test
+//
+// The proxy listens for HTTP-01 challenges on the port that pebble validates
+// them on, which is 5002 in the pebble test configuration, or
+// PEBBLE_HTTP_PORT if set.
+
+func writeTestCertificate(t *testing.T, names ...string) Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("unexpected error generating key: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("unexpected error creating certificate: %s", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("unexpected error encoding key: %s", err)
+	}
+	dir := t.TempDir()
+	cert := Certificate{
+		CertFile: filepath.Join(dir, "cert.pem"),
+		KeyFile:  filepath.Join(dir, "key.pem"),
+	}
+	if err = os.WriteFile(cert.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatalf("unexpected error writing certificate: %s", err)
+	}
+	if err = os.WriteFile(cert.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatalf("unexpected error writing key: %s", err)
+	}
+	return cert
+}
+
+func TestCertManagerHostPolicy(t *testing.T) {
+	certs := newCertManager(&ACME{
+		CacheDir:     t.TempDir(),
+		DirectoryURL: "http://127.0.0.1:1/dir",
+	})
+	if err := certs.update([]Site{
+		{
+			Name:         "a",
+			TerminateTLS: true,
+			Aliases:      []string{"a.example.com", "*.a.example.com", ".b.example.com", "c.example.com/api/", "cert.example.com"},
+			Certificates: map[string]Certificate{
+				"cert.example.com": writeTestCertificate(t, "cert.example.com"),
+			},
+		},
+		{
+			Name:    "b",
+			Aliases: []string{"b.example.net"},
+		},
+	}); err != nil {
+		t.Fatalf("unexpected error updating certificates: %s", err)
+	}
+	for n, test := range [...]struct {
+		Host    string
+		Allowed bool
+	}{
+		{"a.example.com", true},
+		{"a.example.com:80", true},
+		{"x.a.example.com", false},
+		{"b.example.com", false},
+		{"c.example.com", false},
+		{"cert.example.com", false},
+		{"b.example.net", false},
+		{"example.org", false},
+	} {
+		err := certs.hostPolicy(context.Background(), test.Host)
+		if test.Allowed && err != nil {
+			t.Errorf("test %d: host %q: unexpected error: %s", n+1, test.Host, err)
+		} else if !test.Allowed && err != ErrUnknownHost {
+			t.Errorf("test %d: host %q: expecting ErrUnknownHost, got %v", n+1, test.Host, err)
+		}
+	}
+}
+
+func TestCertManagerOwnership(t *testing.T) {
+	certs := newCertManager(&ACME{
+		CacheDir:     t.TempDir(),
+		DirectoryURL: "http://127.0.0.1:1/dir",
+	})
+	if err := certs.update([]Site{
+		{
+			Name:         "a",
+			TerminateTLS: true,
+			Aliases:      []string{"a.example.com", "acme.example.com"},
+			Certificates: map[string]Certificate{
+				"a.example.com": writeTestCertificate(t, "a.example.com"),
+			},
+		},
+		{
+			Name:         "b",
+			TerminateTLS: true,
+			Aliases:      []string{"b.example.com"},
+			Certificates: map[string]Certificate{
+				"b.example.com": writeTestCertificate(t, "b.example.com"),
+			},
+		},
+	}); err != nil {
+		t.Fatalf("unexpected error updating certificates: %s", err)
+	}
+	for n, test := range [...]struct {
+		Site, ServerName, Cert string
+	}{
+		{"a", "a.example.com", "a.example.com"},
+		{"b", "b.example.com", "b.example.com"},
+		{"a", "b.example.com", ""},
+		{"b", "a.example.com", ""},
+		{"b", "acme.example.com", ""},
+		{"c", "a.example.com", ""},
+	} {
+		cert, err := certs.getCertificate(test.Site, &tls.ClientHelloInfo{ServerName: test.ServerName})
+		if test.Cert == "" {
+			if err != proxy.ErrNoCertificate {
+				t.Errorf("test %d: expecting ErrNoCertificate, got %v", n+1, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("test %d: unexpected error: %s", n+1, err)
+			continue
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Errorf("test %d: unexpected error parsing certificate: %s", n+1, err)
+		} else if leaf.Subject.CommonName != test.Cert {
+			t.Errorf("test %d: expecting certificate for %q, got %q", n+1, test.Cert, leaf.Subject.CommonName)
+		}
+	}
+}
+
+func TestACMEIssuance(t *testing.T) {
+	directory := os.Getenv("PEBBLE_DIRECTORY")
+	if directory == "" {
+		t.Skip("PEBBLE_DIRECTORY not set")
+	}
+	port := os.Getenv("PEBBLE_HTTP_PORT")
+	if port == "" {
+		port = "5002"
+	}
+	const name = "acme.example.com"
+	certs := newCertManager(&ACME{
+		CacheDir:     t.TempDir(),
+		DirectoryURL: directory,
+		Email:        "admin@example.com",
+	})
+	// pebble serves its directory with a certificate from its own CA
+	certs.acme.Client.HTTPClient = &http.Client{
+		Transport: pebbleTransport{
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+			},
+		},
+	}
+	if err := certs.update([]Site{{
+		Name:         "acme",
+		TerminateTLS: true,
+		Aliases:      []string{name},
+	}}); err != nil {
+		t.Fatalf("unexpected error updating certificates: %s", err)
+	}
+	l, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		t.Fatalf("unexpected error listening for challenges: %s", err)
+	}
+	p := proxy.New(l, nil)
+	var intercepted atomic.Int32
+	challenges := certs.challengeHandler()
+	p.ACMEChallenges(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.TrimSuffix(r.Host, ":"+port) == name && strings.HasPrefix(r.URL.Path, "/.well-known/acme-challenge/") {
+			intercepted.Add(1)
+		}
+		challenges.ServeHTTP(w, r)
+	}))
+	h, err := p.NewNamedHost("acme", exec.Command("sleep", "60"))
+	if err != nil {
+		t.Fatalf("unexpected error creating host: %s", err)
+	}
+	h.SetTimeouts(0, 100*time.Millisecond)
+	if err = h.AddAliases(name); err != nil {
+		t.Fatalf("unexpected error adding alias: %s", err)
+	}
+	h.TerminateTLS(certs.tlsConfig("acme"))
+	p.Default(h)
+	if err = p.Start(); err != nil {
+		t.Fatalf("unexpected error starting proxy: %s", err)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		p.Shutdown(ctx)
+		cancel()
+	}()
+	cert, err := certs.getCertificate("acme", &tls.ClientHelloInfo{ServerName: name})
+	if err != nil {
+		t.Fatalf("unexpected error getting certificate: %s", err)
+	}
+	if leaf, err := x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		t.Errorf("unexpected error parsing certificate: %s", err)
+	} else if err = leaf.VerifyHostname(name); err != nil {
+		t.Errorf("certificate not valid for %q: %s", name, err)
+	}
+	if intercepted.Load() == 0 {
+		t.Error("no HTTP-01 challenges were answered by the proxy")
+	}
+	if _, err = certs.getCertificate("other", &tls.ClientHelloInfo{ServerName: name}); err != proxy.ErrNoCertificate {
+		t.Errorf("expecting ErrNoCertificate for another site, got %v", err)
+	}
+	if err = certs.hostPolicy(context.Background(), "other.example.com"); err != ErrUnknownHost {
+		t.Errorf("expecting ErrUnknownHost for an unconfigured name, got %v", err)
+	}
+}
+
+// pebbleTransport adds the order URL to the response when finalizing an order.
+//
+// pebble finalizes orders asynchronously, without giving the order URL that
+// the acme package needs to wait for the certificate.
+type pebbleTransport struct {
+	*http.Transport
+}
+
+func (p pebbleTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	resp, err := p.Transport.RoundTrip(r)
+	if err == nil && resp.Header.Get("Location") == "" && strings.Contains(r.URL.Path, "/finalize-order/") {
+		u := *r.URL
+		u.Path = strings.Replace(u.Path, "/finalize-order/", "/my-order/", 1)
+		resp.Header.Set("Location", u.String())
+	}
+	return resp, err
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"vimagination.zapto.org/webserver/proxy"
+)
+
+// admin serves the administration API, allowing hosts to be inspected and
+// managed while the proxy is running
+type admin struct {
+	proxy  *proxy.Proxy
+	reload func() error
+}
+
+func newAdmin(p *proxy.Proxy, reload func() error) *admin {
+	return &admin{
+		proxy:  p,
+		reload: reload,
+	}
+}
+
+// startAdmin serves the admin API on a unix socket at the given path.
+//
+// The socket is created in a private directory and only moved to the given
+// path once its permissions have been restricted, so that it is never
+// reachable by other users. A stale socket at the path is replaced, but any
+// other file is left alone, and ErrNotSocket returned.
+func startAdmin(path string, a *admin) (io.Closer, error) {
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket == 0 {
+		return nil, ErrNotSocket
+	} else if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".admin")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	tmp := filepath.Join(dir, "admin.sock")
+	l, err := net.Listen("unix", tmp)
+	if err != nil {
+		return nil, err
+	}
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	if err = os.Chmod(tmp, 0600); err != nil {
+		l.Close()
+		return nil, err
+	}
+	if err = os.Rename(tmp, path); err != nil {
+		l.Close()
+		return nil, err
+	}
+	s := &http.Server{
+		Handler: a,
+	}
+	go s.Serve(l)
+	return adminSocket{Server: s, path: path}, nil
+}
+
+type adminSocket struct {
+	*http.Server
+	path string
+}
+
+func (a adminSocket) Close() error {
+	err := a.Server.Close()
+	os.Remove(a.path)
+	return err
+}
+
+type hostInfo struct {
+	Name    string
+	Default bool
+	Aliases []string
+}
+
+type hostStatus struct {
+	hostInfo
+	proxy.Status
+}
+
+type aliases struct {
+	Aliases []string
+}
+
+type defaultHost struct {
+	Name string
+}
+
+type errorResponse struct {
+	Error string
+}
+
+func (a *admin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(r.URL.Path, "/")
+	switch path {
+	case "hosts", "status":
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, ErrMethodNotAllowed)
+			return
+		}
+		statuses := a.status()
+		if path == "status" {
+			writeJSON(w, http.StatusOK, statuses)
+			return
+		}
+		infos := make([]hostInfo, len(statuses))
+		for n, s := range statuses {
+			infos[n] = s.hostInfo
+		}
+		writeJSON(w, http.StatusOK, infos)
+		return
+	case "default":
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, ErrMethodNotAllowed)
+			return
+		}
+		var d defaultHost
+		if err := json.NewDecoder(r.Body).Decode(&d); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		host := a.proxy.Host(d.Name)
+		if host == nil {
+			writeError(w, http.StatusNotFound, ErrUnknownSite)
+			return
+		}
+		a.result(w, a.proxy.Default(host))
+		return
+	case "reload":
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, ErrMethodNotAllowed)
+			return
+		}
+		if a.reload == nil {
+			writeError(w, http.StatusNotImplemented, ErrReloadUnsupported)
+			return
+		}
+		a.result(w, a.reload())
+		return
+	}
+	parts := strings.Split(path, "/")
+	if len(parts) != 3 || parts[0] != "hosts" {
+		writeError(w, http.StatusNotFound, ErrNotFound)
+		return
+	}
+	host := a.proxy.Host(parts[1])
+	if host == nil {
+		writeError(w, http.StatusNotFound, ErrUnknownSite)
+		return
+	}
+	switch parts[2] + " " + r.Method {
+	case "restart " + http.MethodPost:
+		a.result(w, host.Restart())
+	case "drain " + http.MethodPost:
+		a.result(w, host.Drain())
+	case "replace " + http.MethodPost:
+		var site Site
+		if err := json.NewDecoder(r.Body).Decode(&site); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if site.Cmd == "" {
+			writeError(w, http.StatusBadRequest, ErrNoCommand)
+			return
+		}
+		a.result(w, host.Replace(site.command()))
+	case "aliases " + http.MethodGet:
+		writeJSON(w, http.StatusOK, aliases{Aliases: host.Aliases()})
+	case "aliases " + http.MethodPost, "aliases " + http.MethodDelete:
+		var as aliases
+		if err := json.NewDecoder(r.Body).Decode(&as); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if r.Method == http.MethodPost {
+			a.result(w, host.AddAliases(as.Aliases...))
+		} else {
+			a.result(w, host.RemoveAlias(as.Aliases...))
+		}
+	default:
+		writeError(w, http.StatusNotFound, ErrNotFound)
+	}
+}
+
+func (a *admin) status() []hostStatus {
+	hosts := a.proxy.Hosts()
+	statuses := make([]hostStatus, len(hosts))
+	for n, host := range hosts {
+		statuses[n] = hostStatus{
+			hostInfo: hostInfo{
+				Name:    host.Name(),
+				Default: a.proxy.IsDefault(host),
+				Aliases: host.Aliases(),
+			},
+			Status: host.Status(),
+		}
+	}
+	return statuses
+}
+
+func (a *admin) result(w http.ResponseWriter, err error) {
+	if err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, errorResponse{Error: err.Error()})
+}
+
+// Errors
+var (
+	ErrMethodNotAllowed  = errors.New("method not allowed")
+	ErrNotFound          = errors.New("not found")
+	ErrUnknownSite       = errors.New("unknown site")
+	ErrNoCommand         = errors.New("no command given")
+	ErrReloadUnsupported = errors.New("reloading not supported")
+	ErrNotSocket         = errors.New("admin socket path is not a socket")
+)
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"vimagination.zapto.org/webserver/proxy"
+)
+
+func TestStartAdminPermissions(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "admin.sock")
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("unexpected error creating stale socket: %s", err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+	s, err := startAdmin(path, newAdmin(nil, nil))
+	if err != nil {
+		t.Fatalf("unexpected error starting admin server: %s", err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("unexpected error checking socket: %s", err)
+	} else if fi.Mode()&os.ModeSocket == 0 {
+		t.Errorf("expecting socket, got mode %s", fi.Mode())
+	} else if perm := fi.Mode().Perm(); perm != 0o600 {
+		t.Errorf("expecting permissions 0600, got %04o", perm)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("expecting only the socket in the directory, got %d entries", len(entries))
+	}
+	c, err := net.Dial("unix", path)
+	if err != nil {
+		t.Errorf("unexpected error connecting to socket: %s", err)
+	} else {
+		c.Close()
+	}
+	if err = s.Close(); err != nil {
+		t.Errorf("unexpected error closing admin server: %s", err)
+	}
+	if _, err = os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expecting socket to be removed, got %v", err)
+	}
+}
+
+func TestStartAdminNotSocket(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.json")
+	if err := os.WriteFile(path, []byte("{}"), 0o600); err != nil {
+		t.Fatalf("unexpected error creating file: %s", err)
+	}
+	if _, err := startAdmin(path, newAdmin(nil, nil)); err != ErrNotSocket {
+		t.Errorf("expecting ErrNotSocket, got %v", err)
+	}
+	if data, err := os.ReadFile(path); err != nil || string(data) != "{}" {
+		t.Errorf("expecting file to be left alone, got %q, %v", data, err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("expecting only the file in the directory, got %d entries", len(entries))
+	}
+}
+
+func newTestAdmin(t *testing.T, reload func() error) (*proxy.Proxy, *admin) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error listening: %s", err)
+	}
+	p := proxy.New(l, nil)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		p.Shutdown(ctx)
+		cancel()
+	})
+	for _, name := range [...]string{"a", "b"} {
+		h, err := p.NewNamedHost(name, exec.Command("sleep", "60"))
+		if err != nil {
+			t.Fatalf("unexpected error creating host %q: %s", name, err)
+		}
+		h.SetReadiness(false)
+		if err = h.AddAliases(name + ".example.com"); err != nil {
+			t.Fatalf("unexpected error adding alias: %s", err)
+		}
+	}
+	p.Default(p.Host("a"))
+	return p, newAdmin(p, reload)
+}
+
+func TestAdminHandler(t *testing.T) {
+	reloads := 0
+	p, a := newTestAdmin(t, func() error {
+		reloads++
+		if reloads > 1 {
+			return errors.New("bad config")
+		}
+		return nil
+	})
+	for n, test := range [...]struct {
+		Method, Path, Body string
+		Status             int
+		Response           string
+	}{
+		{http.MethodGet, "/hosts", "", http.StatusOK, `[{"Name":"a","Default":true,"Aliases":["a.example.com"]},{"Name":"b","Default":false,"Aliases":["b.example.com"]}]`},
+		{http.MethodPost, "/hosts", "", http.StatusMethodNotAllowed, `{"Error":"method not allowed"}`},
+		{http.MethodPost, "/status", "", http.StatusMethodNotAllowed, `{"Error":"method not allowed"}`},
+		{http.MethodGet, "/hosts/b/aliases", "", http.StatusOK, `{"Aliases":["b.example.com"]}`},
+		{http.MethodPost, "/hosts/b/aliases", `{"Aliases":["www.example.com"]}`, http.StatusNoContent, ""},
+		{http.MethodGet, "/hosts/b/aliases", "", http.StatusOK, `{"Aliases":["b.example.com","www.example.com"]}`},
+		{http.MethodPost, "/hosts/a/aliases", `{"Aliases":["www.example.com"]}`, http.StatusConflict, `{"Error":"server alias already in use: www.example.com"}`},
+		{http.MethodDelete, "/hosts/b/aliases", `{"Aliases":["www.example.com"]}`, http.StatusNoContent, ""},
+		{http.MethodGet, "/hosts/b/aliases", "", http.StatusOK, `{"Aliases":["b.example.com"]}`},
+		{http.MethodPost, "/hosts/b/aliases", `{"Aliases":`, http.StatusBadRequest, `{"Error":"unexpected EOF"}`},
+		{http.MethodPost, "/hosts/c/restart", "", http.StatusNotFound, `{"Error":"unknown site"}`},
+		{http.MethodGet, "/hosts/a/restart", "", http.StatusNotFound, `{"Error":"not found"}`},
+		{http.MethodGet, "/hosts/a", "", http.StatusNotFound, `{"Error":"not found"}`},
+		{http.MethodGet, "/other", "", http.StatusNotFound, `{"Error":"not found"}`},
+		{http.MethodPost, "/hosts/a/replace", `{}`, http.StatusBadRequest, `{"Error":"no command given"}`},
+		{http.MethodPost, "/default", `{"Name":"c"}`, http.StatusNotFound, `{"Error":"unknown site"}`},
+		{http.MethodGet, "/default", "", http.StatusMethodNotAllowed, `{"Error":"method not allowed"}`},
+		{http.MethodPost, "/default", `{"Name":"b"}`, http.StatusNoContent, ""},
+		{http.MethodGet, "/hosts", "", http.StatusOK, `[{"Name":"a","Default":false,"Aliases":["a.example.com"]},{"Name":"b","Default":true,"Aliases":["b.example.com"]}]`},
+		{http.MethodPost, "/reload", "", http.StatusNoContent, ""},
+		{http.MethodPost, "/reload", "", http.StatusConflict, `{"Error":"bad config"}`},
+		{http.MethodGet, "/reload", "", http.StatusMethodNotAllowed, `{"Error":"method not allowed"}`},
+	} {
+		w := httptest.NewRecorder()
+		a.ServeHTTP(w, httptest.NewRequest(test.Method, test.Path, strings.NewReader(test.Body)))
+		if w.Code != test.Status {
+			t.Errorf("test %d: %s %s: expecting status %d, got %d", n+1, test.Method, test.Path, test.Status, w.Code)
+		}
+		if body := strings.TrimSpace(w.Body.String()); body != test.Response {
+			t.Errorf("test %d: %s %s: expecting response %s, got %s", n+1, test.Method, test.Path, test.Response, body)
+		}
+	}
+	if !p.IsDefault(p.Host("b")) {
+		t.Error("expecting b to be the default host")
+	}
+}
+
+func TestAdminStatus(t *testing.T) {
+	_, a := newTestAdmin(t, nil)
+	w := httptest.NewRecorder()
+	a.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/status", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expecting status 200, got %d", w.Code)
+	}
+	var statuses []hostStatus
+	if err := json.NewDecoder(w.Body).Decode(&statuses); err != nil {
+		t.Fatalf("unexpected error decoding status: %s", err)
+	}
+	var names []string
+	for _, s := range statuses {
+		names = append(names, s.Name)
+		if !s.Running || !s.Ready || !s.Healthy || len(s.Instances) != 1 || s.PID == 0 {
+			t.Errorf("host %q: expecting a single running, ready and healthy instance, got %+v", s.Name, s.Status)
+		}
+	}
+	if !slices.Equal(names, []string{"a", "b"}) {
+		t.Errorf("expecting hosts a and b, got %q", names)
+	}
+	w = httptest.NewRecorder()
+	a.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/reload", nil))
+	if w.Code != http.StatusNotImplemented {
+		t.Errorf("expecting status 501 without reload, got %d", w.Code)
+	}
+}
@@ -1,7 +1,6 @@
 package main // import "vimagination.zapto.org/webserver/forward"
 
 import (
-	"encoding/binary"
 	"errors"
 	"flag"
 	"io"
@@ -9,8 +8,9 @@ import (
 	"net"
 	"os"
 	"os/signal"
-	"strconv"
-	"syscall"
+	"sync"
+
+	"vimagination.zapto.org/webserver/proxy/client"
 )
 
 var (
@@ -18,6 +18,9 @@ var (
 	httpsAddr = flag.String("s", ":8443", "address to proxy https to")
 	logName   = flag.String("n", "", "name for logging")
 	logger    *log.Logger
+	forwards  sync.WaitGroup
+
+	errDrained = errors.New("drained")
 )
 
 const (
@@ -25,68 +28,33 @@ const (
 	PortHeader = "X-Forwarded-Port"
 )
 
-func proxyConn(envName, toAddr string) error {
-	if hfd, ok := os.LookupEnv(envName); ok {
-		fd, _ := strconv.ParseUint(hfd, 10, 0)
-		os.Unsetenv(envName)
-		c, err := net.FileConn(os.NewFile(uintptr(fd), ""))
+func proxyConn(l net.Listener, toAddr string) error {
+	if l == nil {
+		return nil
+	}
+	for {
+		c, err := l.Accept()
 		if err != nil {
-			return err
-		}
-		u, ok := c.(*net.UnixConn)
-		if !ok {
-			return errors.New("invalid socket type")
-		}
-		length := make([]byte, 4)
-		oob := make([]byte, syscall.CmsgSpace(4))
-		for {
-			_, _, _, _, err = u.ReadMsgUnix(length, oob)
-			if err != nil {
-				return err
-			}
-			buf := make([]byte, binary.LittleEndian.Uint32(length))
-			if len(buf) > 0 {
-				_, err = u.Read(buf)
-				if err != nil {
-					return err
-				}
-			}
-			msg, err := syscall.ParseSocketControlMessage(oob)
-			if err != nil {
-				return err
+			if errors.Is(err, net.ErrClosed) {
+				return errDrained
 			}
-			if len(msg) != 1 {
-				return errors.New("invalid number of socket control messages")
-			}
-			fd, err := syscall.ParseUnixRights(&msg[0])
-			if err != nil {
-				return err
-			}
-			if len(fd) != 1 {
-				return errors.New("invalid number of file descriptors")
-			}
-			c, err := net.FileConn(os.NewFile(uintptr(fd[0]), ""))
-			if err != nil {
-				return err
-			}
-			// add IPHeader and PortHeader
-			go forward(buf, c, toAddr)
+			return err
 		}
+		// add IPHeader and PortHeader
+		forwards.Add(1)
+		go forward(c, toAddr)
 	}
-	return nil
 }
 
-func forward(buf []byte, c net.Conn, toAddr string) {
+func forward(c net.Conn, toAddr string) {
+	defer forwards.Done()
+	defer c.Close()
 	f, err := net.Dial("tcp", toAddr)
 	if err != nil {
 		logger.Println("error connecting to host: ", err)
 		return
 	}
-	_, err = f.Write(buf)
-	if err != nil {
-		logger.Println("error forwarding buffer: ", err)
-		return
-	}
+	defer f.Close()
 	ec := make(chan error, 1)
 	go copyConn(c, f, ec)
 	go copyConn(f, c, ec)
@@ -107,10 +75,10 @@ func main() {
 	logger = log.New(os.Stderr, *logName, log.LstdFlags)
 	ec := make(chan error, 1)
 	go func() {
-		ec <- proxyConn("proxyHTTPSocket", *httpAddr)
+		ec <- proxyConn(client.HTTPListener(), *httpAddr)
 	}()
 	go func() {
-		ec <- proxyConn("proxyHTTPSSocket", *httpsAddr)
+		ec <- proxyConn(client.HTTPSListener(), *httpsAddr)
 	}()
 
 	cc := make(chan struct{})
@@ -139,6 +107,9 @@ func main() {
 	default:
 		if err == nil {
 			logger.Println("no sockets")
+		} else if err == errDrained {
+			logger.Println("Draining")
+			forwards.Wait()
 		} else {
 			logger.Println(err)
 		}
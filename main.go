@@ -1,17 +1,21 @@
 package main // import "vimagination.zapto.org/webserver"
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
+	"fmt"
+	"io"
 	"log"
 	"net"
 	"os"
 	"os/exec"
 	"os/signal"
-	"sync"
 	"syscall"
+	"time"
 
 	"vimagination.zapto.org/webserver/proxy"
+	"vimagination.zapto.org/webserver/proxy/activation"
 )
 
 type Site struct {
@@ -23,14 +27,185 @@ type Site struct {
 	WorkingDir string
 	Env        []string
 	Uid, Gid   uint32
+
+	// Restart is the restart policy for the site, one of "always",
+	// "on-failure" or "never", which is the default
+	Restart       string
+	MinBackoff    Duration
+	MaxBackoff    Duration
+	MaxRestarts   int
+	RestartWindow Duration
+
+	HealthCheck *HealthCheck
+
+	// Instances is the number of copies of the command to run, defaulting
+	// to one, and Balance is how connections are spread across them, one
+	// of "round-robin", which is the default, or "least-connections"
+	Instances int
+	Balance   string
+
+	// OnDemand delays starting the site until its first connection, and
+	// IdleTimeout, if set, stops the site after that long without
+	// connections, for the next connection to start it again
+	OnDemand    bool
+	IdleTimeout Duration
+
+	// CPU, Memory, Pids and Files limit the resources available to the
+	// site, as the number of CPUs, bytes of memory, running processes and
+	// threads, and open files for each process. Without a Cgroup, Pids
+	// counts all processes of the user, and so needs the site to have its
+	// own Uid and Gid
+	CPU    float64
+	Memory int64
+	Pids   int
+	Files  int
+
+	// StartTimeout is how long a new process has to become ready, and
+	// DrainTimeout how long an old process has to finish its connections,
+	// when the site is restarted or replaced
+	StartTimeout, DrainTimeout Duration
+
+	// NoReadiness treats the processes of the site as ready as soon as
+	// they are started, for commands that do not use proxy/client to
+	// report when they are ready
+	NoReadiness bool
+
+	// TerminateTLS makes the proxy handle TLS for the site, using the
+	// Certificates, which are keyed by alias, or ACME
+	TerminateTLS bool
+	Certificates map[string]Certificate
+}
+
+func (s *Site) command() *exec.Cmd {
+	cmd := exec.Command(s.Cmd, s.Arguments...)
+	cmd.Dir = s.WorkingDir
+	cmd.Env = s.Env
+	if s.Uid != 0 && s.Gid != 0 {
+		cmd.SysProcAttr = &syscall.SysProcAttr{
+			Credential: &syscall.Credential{
+				Uid: s.Uid,
+				Gid: s.Gid,
+			},
+		}
+	}
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd
+}
+
+func (s *Site) restartPolicy() (proxy.RestartPolicy, error) {
+	policy := proxy.RestartPolicy{
+		MinBackoff:  time.Duration(s.MinBackoff),
+		MaxBackoff:  time.Duration(s.MaxBackoff),
+		MaxRestarts: s.MaxRestarts,
+		Window:      time.Duration(s.RestartWindow),
+	}
+	switch s.Restart {
+	case "", "never":
+		policy.Mode = proxy.RestartNever
+	case "on-failure":
+		policy.Mode = proxy.RestartOnFailure
+	case "always":
+		policy.Mode = proxy.RestartAlways
+	default:
+		return policy, fmt.Errorf("unknown restart policy: %q", s.Restart)
+	}
+	return policy, nil
+}
+
+func (s *Site) balance() (proxy.Balance, error) {
+	switch s.Balance {
+	case "", "round-robin":
+		return proxy.BalanceRoundRobin, nil
+	case "least-connections":
+		return proxy.BalanceLeastConnections, nil
+	}
+	return 0, fmt.Errorf("unknown balance mode: %q", s.Balance)
+}
+
+type HealthCheck struct {
+	// Path is requested from the site, and Addr is dialled, to determine
+	// its health
+	Path, Addr        string
+	Interval, Timeout Duration
+	Failures          int
+
+	// Fallback is the name of the site that receives connections while the
+	// site is unhealthy, otherwise Status is returned
+	Fallback string
+	Status   int
+}
+
+// Duration is a time.Duration that is encoded in JSON as a string, such as
+// "1m30s"
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	td, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(td)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+type Certificate struct {
+	CertFile, KeyFile string
 }
 
 type Config struct {
+	// HTTPAddr and HTTPSAddr are the addresses to listen on, unless
+	// listeners named "http" and "https" are passed by systemd socket
+	// activation, with other listeners being used in that order
 	HTTPAddr  string
 	HTTPSAddr string
-	Sites     []Site
+
+	// ACME enables the automatic retrieval of certificates for the
+	// aliases of sites with TerminateTLS set, and without a configured
+	// certificate. Sites without TerminateTLS manage their own
+	// certificates
+	ACME *ACME
+
+	// HTTPProxyProtocol and HTTPSProxyProtocol list the networks, in CIDR
+	// notation, of load balancers that will send a PROXY protocol header on
+	// the respective listener
+	HTTPProxyProtocol  []string
+	HTTPSProxyProtocol []string
+
+	// HTTPMode and HTTPSMode set how connections on the respective listener
+	// are passed to sites; either "transfer", the default, which passes the
+	// connection itself, or "reverse-proxy", which forwards each request
+	HTTPMode  string
+	HTTPSMode string
+
+	// AdminSocket is the path of a unix socket on which to serve the
+	// administration API
+	AdminSocket string
+
+	// Cgroup is a cgroup v2 directory, delegated to the proxy, under which
+	// a cgroup is created for each site to enforce its limits. Without it,
+	// the limits are enforced with rlimits where possible
+	Cgroup string
+
+	// ShutdownTimeout is how long sites have to finish their connections
+	// and exit when the proxy is stopped, after which they are killed. It
+	// is also how long connections handled by the proxy itself have to
+	// finish when upgrading on SIGUSR2
+	ShutdownTimeout Duration
+
+	Sites []Site
 }
 
+const defaultShutdownTimeout = 30 * time.Second
+
 var configFile = flag.String("c", "", "configuration file")
 
 func main() {
@@ -40,109 +215,201 @@ func main() {
 		logger.Println("no configuration file")
 		return
 	}
-	f, err := os.Open(*configFile)
+	config, err := readConfig(*configFile)
 	if err != nil {
-		logger.Println("error opening configuarion file: ", err)
+		logger.Println("error reading configuration file: ", err)
 		return
 	}
-	var config Config
-	err = json.NewDecoder(f).Decode(&config)
-	f.Close()
-	if err != nil {
-		logger.Println("error reading configuration file: ", err)
+	if err = config.validate(); err != nil {
+		logger.Println("invalid configuration: ", err)
 		return
 	}
-	if len(config.Sites) == 0 {
-		logger.Println("no sites configured")
+	p, err := proxy.Resume()
+	if err != nil {
+		logger.Println("error resuming after upgrade: ", err)
 		return
+	} else if p != nil {
+		logger.Println("Resumed after upgrade")
+	} else {
+		http, https := listen(logger, config)
+		if http == nil && https == nil {
+			logger.Println("no working listeners")
+			return
+		}
+		p = proxy.New(http, https)
 	}
-	var http, https net.Listener
-	if config.HTTPAddr != "" {
-		http, err = net.Listen("tcp", config.HTTPAddr)
+	p.SetLogger(logger)
+	if len(config.HTTPProxyProtocol) > 0 {
+		trusted, err := parseCIDRs(config.HTTPProxyProtocol)
 		if err != nil {
-			logger.Println("error opening HTTP listener: ", err)
+			logger.Println("error parsing HTTP PROXY protocol networks: ", err)
+			return
+		}
+		if err = p.ProxyProtocol(false, trusted...); err != nil {
+			logger.Println("error setting HTTP PROXY protocol networks: ", err)
+			return
 		}
 	}
-	if config.HTTPSAddr != "" {
-		https, err = net.Listen("tcp", config.HTTPSAddr)
+	if len(config.HTTPSProxyProtocol) > 0 {
+		trusted, err := parseCIDRs(config.HTTPSProxyProtocol)
 		if err != nil {
-			logger.Println("error opening HTTPS listener: ", err)
+			logger.Println("error parsing HTTPS PROXY protocol networks: ", err)
+			return
+		}
+		if err = p.ProxyProtocol(true, trusted...); err != nil {
+			logger.Println("error setting HTTPS PROXY protocol networks: ", err)
+			return
 		}
 	}
-	if http == nil && https == nil {
-		logger.Println("no working listeners")
+	httpMode, err := parseMode(config.HTTPMode)
+	if err != nil {
+		logger.Println("error setting HTTP listener mode: ", err)
 		return
 	}
-	p := proxy.New(http, https)
-
-	cmds := make([]*exec.Cmd, 0, len(config.Sites))
+	p.SetMode(false, httpMode)
+	httpsMode, err := parseMode(config.HTTPSMode)
+	if err != nil {
+		logger.Println("error setting HTTPS listener mode: ", err)
+		return
+	}
+	p.SetMode(true, httpsMode)
+	if config.Cgroup != "" {
+		if err := p.SetCgroup(config.Cgroup); err != nil {
+			logger.Println("error setting up cgroup, falling back to rlimits: ", err)
+		}
+	}
 
-	for _, site := range config.Sites {
-		cmd := exec.Command(site.Cmd, site.Arguments...)
-		cmd.Dir = site.WorkingDir
-		cmd.Env = site.Env
-		if site.Uid != 0 && site.Gid != 0 {
-			cmd.SysProcAttr = &syscall.SysProcAttr{
-				Credential: &syscall.Credential{
-					Uid: site.Uid,
-					Gid: site.Gid,
-				},
-			}
+	certs := newCertManager(config.ACME)
+	if h := certs.challengeHandler(); h != nil {
+		p.ACMEChallenges(h)
+	}
+	s := newServer(p, certs)
+	if err = s.apply(config); err != nil {
+		logger.Println("error configuring sites: ", err)
+		if _, ok := err.(ErrSites); !ok {
+			return
 		}
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		host, err := p.NewHost(cmd)
+	}
+	reload := func() error {
+		return s.reload(*configFile)
+	}
+
+	var adminServer io.Closer
+	if config.AdminSocket != "" {
+		adminServer, err = startAdmin(config.AdminSocket, newAdmin(p, reload))
 		if err != nil {
-			logger.Printf("error adding host %q: %s\n", site.Name, err)
-			continue
-		}
-		if site.Default {
-			p.Default(host)
+			logger.Println("error starting admin server: ", err)
 		}
-		host.AddAliases(site.Aliases...)
-		cmds = append(cmds, cmd)
 	}
 
-	cc := make(chan struct{})
+	if err = p.Start(); err != nil {
+		logger.Println(err)
+		return
+	}
+	ec := make(chan error, 1)
 	go func() {
-		logger.Println("Server Started")
-		sc := make(chan os.Signal, 1)
-		signal.Notify(sc, os.Interrupt)
+		ec <- p.Wait()
+	}()
+	logger.Println("Server Started")
+
+	shutdownTimeout := time.Duration(config.ShutdownTimeout)
+	if shutdownTimeout <= 0 {
+		shutdownTimeout = defaultShutdownTimeout
+	}
+	sc := make(chan os.Signal, 1)
+	signal.Notify(sc, os.Interrupt, syscall.SIGHUP, syscall.SIGUSR2)
+Loop:
+	for {
 		select {
-		case <-sc:
+		case sig := <-sc:
+			switch sig {
+			case syscall.SIGHUP:
+				logger.Println("Reloading configuration")
+				go func() {
+					if err := reload(); err != nil {
+						logger.Println("error reloading configuration: ", err)
+					}
+				}()
+				continue
+			case syscall.SIGUSR2:
+				logger.Println("Upgrading")
+				ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+				err := p.Upgrade(ctx)
+				cancel()
+				logger.Println("error upgrading: ", err)
+				continue
+			}
 			logger.Println("Closing")
-		case <-cc:
+			break Loop
+		case err := <-ec:
+			logger.Println(err)
+			break Loop
 		}
-		signal.Stop(sc)
-		close(sc)
-		if http != nil {
-			http.Close()
+	}
+	signal.Stop(sc)
+	if adminServer != nil {
+		adminServer.Close()
+	}
+
+	logger.Println("Waiting for clients to close")
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	exits, err := p.Shutdown(ctx)
+	cancel()
+	for _, e := range exits {
+		if e.Clean() {
+			logger.Printf("host %s: process %d exited cleanly\n", e.Name, e.PID)
+		} else if e.Killed {
+			logger.Printf("host %s: process %d killed\n", e.Name, e.PID)
+		} else {
+			logger.Printf("host %s: process %d exited: %s\n", e.Name, e.PID, e.Err)
 		}
-		if https != nil {
-			https.Close()
+	}
+	if err != nil {
+		logger.Println("error shutting down: ", err)
+	}
+	logger.Println("done")
+}
+
+// listen opens the HTTP and HTTPS listeners, preferring those passed by
+// systemd socket activation
+func listen(logger *log.Logger, config *Config) (net.Listener, net.Listener) {
+	http, https, err := activation.HTTP()
+	if err != nil {
+		logger.Println("error reading systemd sockets: ", err)
+	}
+	if http == nil && config.HTTPAddr != "" {
+		http, err = net.Listen("tcp", config.HTTPAddr)
+		if err != nil {
+			logger.Println("error opening HTTP listener: ", err)
 		}
-		close(cc)
-	}()
+	}
+	if https == nil && config.HTTPSAddr != "" {
+		https, err = net.Listen("tcp", config.HTTPSAddr)
+		if err != nil {
+			logger.Println("error opening HTTPS listener: ", err)
+		}
+	}
+	return http, https
+}
 
-	err = p.Run()
+func parseMode(mode string) (proxy.ListenerMode, error) {
+	switch mode {
+	case "", "transfer":
+		return proxy.ModeTransfer, nil
+	case "reverse-proxy":
+		return proxy.ModeReverseProxy, nil
+	}
+	return 0, fmt.Errorf("unknown listener mode: %q", mode)
+}
 
-	select {
-	case <-cc:
-	default:
-		logger.Println(err)
-		cc <- struct{}{}
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
 	}
-	<-cc
-	logger.Println("Waiting for clients to close")
-	var wg sync.WaitGroup
-	wg.Add(len(cmds))
-	for _, cmd := range cmds {
-		go func(cmd *exec.Cmd) {
-			cmd.Process.Signal(os.Interrupt)
-			cmd.Wait()
-			wg.Done()
-		}(cmd)
-	}
-	wg.Wait()
-	logger.Println("done")
+	return nets, nil
 }
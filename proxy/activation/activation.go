@@ -0,0 +1,118 @@
+// Package activation retrieves the listening sockets passed to a process by
+// systemd socket activation.
+package activation // import "vimagination.zapto.org/webserver/proxy/activation"
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// listenFDsStart is the first file descriptor passed by systemd
+const listenFDsStart = 3
+
+// Listener is a listening socket passed to the process, along with its name
+// from LISTEN_FDNAMES, which will be empty if none was given
+type Listener struct {
+	Name string
+	net.Listener
+}
+
+var (
+	once      sync.Once
+	listeners []Listener
+	err       error
+)
+
+// Listeners returns the listening sockets passed to the process with the
+// LISTEN_FDS environment variable, in the order they were passed. The sockets
+// are only used if LISTEN_PID is set to the process ID, as they were otherwise
+// meant for another process.
+//
+// The environment variables are read, and removed so they are not inherited by
+// child processes, on the first call, with later calls returning the same
+// listeners. Sockets that are not stream listeners are closed and ignored.
+func Listeners() ([]Listener, error) {
+	once.Do(readListeners)
+	return listeners, err
+}
+
+func readListeners() {
+	pid, hasPID := os.LookupEnv("LISTEN_PID")
+	fds, hasFDs := os.LookupEnv("LISTEN_FDS")
+	names := os.Getenv("LISTEN_FDNAMES")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	if !hasFDs {
+		return
+	}
+	if !hasPID || pid != strconv.Itoa(os.Getpid()) {
+		return
+	}
+	n, e := strconv.ParseUint(fds, 10, 16)
+	if e != nil {
+		err = e
+		return
+	}
+	var fdNames []string
+	if names != "" {
+		fdNames = strings.Split(names, ":")
+	}
+	for i := 0; i < int(n); i++ {
+		fd := listenFDsStart + i
+		syscall.CloseOnExec(fd)
+		var name string
+		if i < len(fdNames) {
+			name = fdNames[i]
+		}
+		f := os.NewFile(uintptr(fd), name)
+		l, e := net.FileListener(f)
+		f.Close()
+		if e != nil {
+			continue
+		}
+		listeners = append(listeners, Listener{Name: name, Listener: l})
+	}
+}
+
+// HTTP returns the listeners to be used for HTTP and HTTPS connections.
+//
+// Listeners named "http" and "https" are used for their respective protocols,
+// with any other listeners being used, in order, for whichever of them has not
+// been given a named listener. This includes listeners with other names, as
+// systemd names listeners after their socket unit by default.
+func HTTP() (net.Listener, net.Listener, error) {
+	ls, err := Listeners()
+	if err != nil {
+		return nil, nil, err
+	}
+	http, https := httpListeners(ls)
+	return http, https, nil
+}
+
+func httpListeners(ls []Listener) (net.Listener, net.Listener) {
+	var http, https net.Listener
+	for _, l := range ls {
+		switch l.Name {
+		case "http":
+			http = l.Listener
+		case "https":
+			https = l.Listener
+		}
+	}
+	for _, l := range ls {
+		if l.Name == "http" || l.Name == "https" {
+			continue
+		}
+		if http == nil {
+			http = l.Listener
+		} else if https == nil {
+			https = l.Listener
+		}
+	}
+	return http, https
+}
@@ -0,0 +1,61 @@
+package activation
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+type testListener struct {
+	net.Listener
+	name string
+}
+
+func TestHTTPListeners(t *testing.T) {
+	for n, test := range [...]struct {
+		Names       string
+		HTTP, HTTPS string
+	}{
+		{"", "", ""},
+		{"http", "http", ""},
+		{"https", "", "https"},
+		{"http:https", "http", "https"},
+		{"https:http", "http", "https"},
+		{":", "0", "1"},
+		{"::", "0", "1"},
+		{"https:", "1", "https"},
+		{":http", "http", "0"},
+		{"webserver.socket", "webserver.socket", ""},
+		{"webserver.socket:webserver.socket", "webserver.socket", "webserver.socket"},
+		{"webserver.socket:http", "http", "webserver.socket"},
+		{"https:webserver.socket:other", "webserver.socket", "https"},
+	} {
+		var ls []Listener
+		if test.Names != "" {
+			for m, name := range strings.Split(test.Names, ":") {
+				id := name
+				if id == "" {
+					id = string(rune('0' + m))
+				}
+				ls = append(ls, Listener{Name: name, Listener: testListener{name: id}})
+			}
+		}
+		http, https := httpListeners(ls)
+		for _, l := range [...]struct {
+			Protocol string
+			Listener net.Listener
+			Expect   string
+		}{
+			{"http", http, test.HTTP},
+			{"https", https, test.HTTPS},
+		} {
+			var got string
+			if l.Listener != nil {
+				got = l.Listener.(testListener).name
+			}
+			if got != l.Expect {
+				t.Errorf("test %d: names %q: expecting %s listener %q, got %q", n+1, test.Names, l.Protocol, l.Expect, got)
+			}
+		}
+	}
+}
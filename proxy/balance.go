@@ -0,0 +1,206 @@
+package proxy
+
+import "time"
+
+// Balance determines how connections are spread across the instances of a host
+type Balance uint8
+
+// Balance Modes
+const (
+	// BalanceRoundRobin passes connections to each instance in turn
+	BalanceRoundRobin Balance = iota
+	// BalanceLeastConnections passes each connection to the instance
+	// handling the fewest connections, as reported by the instances
+	BalanceLeastConnections
+)
+
+// SetInstances sets how many copies of the host command are run, with
+// connections being spread across them according to the balance mode. The
+// default is a single instance.
+//
+// Additional instances are started immediately, and any instances beyond the
+// new number are drained. If the host is stopped, the number takes effect when
+// it is next started.
+func (h *Host) SetInstances(n int) error {
+	if n < 1 {
+		n = 1
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.removed {
+		return ErrRemoved
+	}
+	h.instances = n
+	if h.stopped || len(h.procs) == 0 {
+		return nil
+	}
+	if len(h.procs) > n {
+		drainTimeout := h.drainTimeout
+		for _, pr := range h.procs[n:] {
+			go pr.drain(drainTimeout)
+		}
+		h.procs = append([]*process(nil), h.procs[:n]...)
+		h.closeIdleLocked()
+		h.updateHealthLocked(nil)
+		return nil
+	}
+	for len(h.procs) < n {
+		pr, err := h.setupCmd(copyCmd(h.template))
+		if err != nil {
+			return err
+		}
+		h.procs = append(h.procs, pr)
+		h.updateHealthLocked(nil)
+		go h.awaitReady(pr)
+	}
+	return nil
+}
+
+// SetBalance sets how connections are spread across the instances of the host
+func (h *Host) SetBalance(b Balance) {
+	h.mu.Lock()
+	h.balance = b
+	h.mu.Unlock()
+}
+
+// instance returns the index of the process among the current instances of
+// the host, or -1 if it is not one of them.
+//
+// Must be called with the lock held.
+func (h *Host) instance(pr *process) int {
+	for n, p := range h.procs {
+		if p == pr {
+			return n
+		}
+	}
+	return -1
+}
+
+// processes returns a copy of the current instances of the host
+func (h *Host) processes() []*process {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return append([]*process(nil), h.procs...)
+}
+
+// getProcess returns the instance that should receive the next connection,
+// preferring those that are ready, or nil if none are running and in rotation.
+//
+// An idle host is started first, with any error starting it returned, in
+// which case the host remains idle and healthy.
+func (h *Host) getProcess() (*process, error) {
+	h.used()
+	h.mu.RLock()
+	if h.idle {
+		h.mu.RUnlock()
+		if err := h.wake(); err != nil {
+			return nil, err
+		}
+		h.mu.RLock()
+	}
+	defer h.mu.RUnlock()
+	if h.stopped || len(h.procs) == 0 {
+		return nil, nil
+	}
+	var (
+		best      *process
+		bestReady bool
+		start     = int(h.next.Add(1) % uint32(len(h.procs)))
+	)
+	for n := range h.procs {
+		pr := h.procs[(start+n)%len(h.procs)]
+		if pr.unhealthy || pr.exited() {
+			continue
+		}
+		ready := pr.ready()
+		if best != nil {
+			if bestReady && !ready {
+				continue
+			}
+			if bestReady == ready && (h.balance == BalanceRoundRobin || pr.connections() >= best.connections()) {
+				continue
+			}
+		}
+		best, bestReady = pr, ready
+	}
+	return best, nil
+}
+
+// instanceFailed takes an instance out of rotation after a connection could
+// not be passed to it.
+//
+// Without active health checks, the instance is returned to rotation after the
+// health check interval, so that a passing failure does not leave the host
+// down.
+func (h *Host) instanceFailed(pr *process, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	wasHealthy := !pr.unhealthy
+	h.setInstanceHealthyLocked(pr, false, err)
+	if wasHealthy && h.healthStop == nil {
+		interval := h.health.Interval
+		if interval <= 0 {
+			interval = DefaultHealthInterval
+		}
+		time.AfterFunc(interval, func() {
+			h.recoverInstance(pr)
+		})
+	}
+}
+
+// recoverInstance returns an instance to rotation, unless active health checks
+// have since been started, or the instance is not ready, in which case it is
+// returned once it is
+func (h *Host) recoverInstance(pr *process) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.healthStop == nil && pr.ready() {
+		h.setInstanceHealthyLocked(pr, true, nil)
+	}
+}
+
+func (h *Host) setInstanceHealthy(pr *process, healthy bool, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.setInstanceHealthyLocked(pr, healthy, err)
+}
+
+// setInstanceHealthyLocked puts an instance into, or takes it out of,
+// rotation, updating the health of the host.
+//
+// Must be called with the lock held.
+func (h *Host) setInstanceHealthyLocked(pr *process, healthy bool, err error) {
+	n := h.instance(pr)
+	if n < 0 {
+		return
+	}
+	if pr.unhealthy == healthy {
+		pr.unhealthy = !healthy
+		if len(h.procs) > 1 {
+			if healthy {
+				h.proxy.logf("host %s: instance %d (process %d) is healthy\n", h.name, n, pr.pid())
+			} else {
+				h.proxy.logf("host %s: instance %d (process %d) is unhealthy: %s\n", h.name, n, pr.pid(), err)
+			}
+		}
+	}
+	h.updateHealthLocked(err)
+}
+
+// updateHealthLocked marks the host as healthy while any of its instances are
+// running and in rotation, otherwise marking it unhealthy with the given
+// error.
+//
+// Must be called with the lock held.
+func (h *Host) updateHealthLocked(err error) {
+	for _, pr := range h.procs {
+		if !pr.unhealthy && !pr.exited() {
+			h.setHealthyLocked(true, nil)
+			return
+		}
+	}
+	if err == nil {
+		err = ErrNotRunning
+	}
+	h.setHealthyLocked(false, err)
+}
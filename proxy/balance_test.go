@@ -0,0 +1,205 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	"vimagination.zapto.org/webserver/proxy/wire"
+)
+
+type testInstance struct {
+	Conns            int64
+	Ready, Unhealthy bool
+}
+
+func newTestInstance(i testInstance) *process {
+	pr := newTestProcess()
+	pr.httpTransfer = &transfer{ready: make(chan struct{})}
+	pr.httpTransfer.conns.Store(i.Conns)
+	if i.Ready {
+		pr.httpTransfer.markReady()
+	}
+	pr.unhealthy = i.Unhealthy
+	return pr
+}
+
+func TestGetProcess(t *testing.T) {
+	p := newTestProxy(t)
+	for n, test := range [...]struct {
+		Balance   Balance
+		Instances []testInstance
+		Picks     []int
+	}{
+		{
+			Balance:   BalanceRoundRobin,
+			Instances: []testInstance{{Ready: true}, {Ready: true}, {Ready: true}},
+			Picks:     []int{1, 2, 0, 1, 2, 0},
+		},
+		{
+			Balance:   BalanceRoundRobin,
+			Instances: []testInstance{{Ready: true}, {Ready: true, Unhealthy: true}, {Ready: true}},
+			Picks:     []int{2, 2, 0, 2, 2, 0},
+		},
+		{
+			Balance:   BalanceRoundRobin,
+			Instances: []testInstance{{Ready: true}, {}, {Ready: true}},
+			Picks:     []int{2, 2, 0, 2, 2, 0},
+		},
+		{
+			Balance:   BalanceRoundRobin,
+			Instances: []testInstance{{}, {}},
+			Picks:     []int{1, 0, 1, 0},
+		},
+		{
+			Balance:   BalanceRoundRobin,
+			Instances: []testInstance{{Ready: true, Unhealthy: true}, {Ready: true, Unhealthy: true}},
+			Picks:     []int{-1, -1},
+		},
+		{
+			Balance:   BalanceLeastConnections,
+			Instances: []testInstance{{Ready: true, Conns: 3}, {Ready: true, Conns: 1}, {Ready: true, Conns: 2}},
+			Picks:     []int{1, 1, 1},
+		},
+		{
+			Balance:   BalanceLeastConnections,
+			Instances: []testInstance{{Ready: true, Conns: 3}, {Ready: true, Conns: 1, Unhealthy: true}, {Ready: true, Conns: 2}},
+			Picks:     []int{2, 2, 2},
+		},
+		{
+			Balance:   BalanceLeastConnections,
+			Instances: []testInstance{{Ready: true, Conns: 3}, {Conns: 0}, {Ready: true, Conns: 2}},
+			Picks:     []int{2, 2, 2},
+		},
+		{
+			Balance:   BalanceLeastConnections,
+			Instances: []testInstance{{Ready: true, Conns: 1}, {Ready: true, Conns: 1}},
+			Picks:     []int{1, 0, 1, 0},
+		},
+		{
+			Balance:   BalanceLeastConnections,
+			Instances: []testInstance{{Ready: true, Unhealthy: true}, {Ready: true, Unhealthy: true}},
+			Picks:     []int{-1, -1},
+		},
+	} {
+		h := &Host{
+			proxy:   p,
+			name:    "host",
+			balance: test.Balance,
+		}
+		for _, i := range test.Instances {
+			h.procs = append(h.procs, newTestInstance(i))
+		}
+		picks := make([]int, 0, len(test.Picks))
+		for range test.Picks {
+			pr, err := h.getProcess()
+			if err != nil {
+				t.Fatalf("test %d: unexpected error: %s", n+1, err)
+			}
+			picks = append(picks, h.instance(pr))
+		}
+		if !slices.Equal(picks, test.Picks) {
+			t.Errorf("test %d: expecting instances %v, got %v", n+1, test.Picks, picks)
+		}
+	}
+}
+
+func TestInstanceHealth(t *testing.T) {
+	p := newTestProxy(t)
+	h := &Host{
+		proxy: p,
+		name:  "host",
+		procs: []*process{newTestInstance(testInstance{Ready: true}), newTestInstance(testInstance{Ready: true})},
+	}
+	h.setHealthy(true, nil)
+	errFailed := errors.New("failed")
+	for n, test := range [...]struct {
+		Instance int
+		Healthy  bool
+		Host     bool
+		Picks    []int
+	}{
+		{0, false, true, []int{1, 1}},
+		{1, false, false, []int{-1, -1}},
+		{0, true, true, []int{0, 0}},
+		{1, true, true, []int{1, 0}},
+	} {
+		h.setInstanceHealthy(h.procs[test.Instance], test.Healthy, errFailed)
+		if healthy := h.Healthy(); healthy != test.Host {
+			t.Errorf("test %d: expecting host healthy %v, got %v", n+1, test.Host, healthy)
+		}
+		target, _ := h.route()
+		if (target == h) != test.Host {
+			t.Errorf("test %d: expecting host to be routed to %v, got %v", n+1, test.Host, target == h)
+		}
+		picks := make([]int, 0, len(test.Picks))
+		for range test.Picks {
+			pr, _ := h.getProcess()
+			picks = append(picks, h.instance(pr))
+		}
+		if !slices.Equal(picks, test.Picks) {
+			t.Errorf("test %d: expecting instances %v, got %v", n+1, test.Picks, picks)
+		}
+	}
+}
+
+func TestClosedAccounting(t *testing.T) {
+	p := newTestProxy(t)
+	h := &Host{
+		proxy:   p,
+		name:    "host",
+		balance: BalanceLeastConnections,
+	}
+	var children [2]*net.UnixConn
+	for n := range children {
+		tr, err := newTransfer()
+		if err != nil {
+			t.Fatalf("unexpected error creating transfer: %s", err)
+		}
+		defer tr.Close()
+		fc, err := net.FileConn(tr.f)
+		if err != nil {
+			t.Fatalf("unexpected error opening child socket: %s", err)
+		}
+		defer fc.Close()
+		children[n] = fc.(*net.UnixConn)
+		tr.started()
+		tr.markReady()
+		pr := newTestProcess()
+		pr.httpTransfer = tr
+		h.procs = append(h.procs, pr)
+	}
+	h.procs[0].httpTransfer.conns.Store(4)
+	h.procs[1].httpTransfer.conns.Store(2)
+	for n, test := range [...]struct {
+		Instance, Closed int
+		Conns            [2]int64
+		Pick             int
+	}{
+		{0, 0, [2]int64{4, 2}, 1},
+		{0, 1, [2]int64{3, 2}, 1},
+		{0, 2, [2]int64{1, 2}, 0},
+		{1, 2, [2]int64{1, 0}, 1},
+	} {
+		for i := 0; i < test.Closed; i++ {
+			if err := wire.WriteControl(children[test.Instance], wire.TypeClosed); err != nil {
+				t.Fatalf("test %d: unexpected error sending closed message: %s", n+1, err)
+			}
+		}
+		var conns [2]int64
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			conns = [2]int64{h.procs[0].connections(), h.procs[1].connections()}
+			if conns == test.Conns {
+				break
+			}
+		}
+		if conns != test.Conns {
+			t.Errorf("test %d: expecting connections %v, got %v", n+1, test.Conns, conns)
+		}
+		if pr, _ := h.getProcess(); h.instance(pr) != test.Pick {
+			t.Errorf("test %d: expecting instance %d, got %d", n+1, test.Pick, h.instance(pr))
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"errors"
+	"strings"
+	"sync"
+)
+
+// Certificates is a store of TLS certificates keyed by host alias.
+//
+// Aliases can use the same wildcard forms as Host aliases, and are matched
+// against the TLS server name with the same precedence.
+type Certificates struct {
+	mu    sync.RWMutex
+	certs map[string]*tls.Certificate
+}
+
+// NewCertificates creates a new, empty, certificate store
+func NewCertificates() *Certificates {
+	return &Certificates{
+		certs: make(map[string]*tls.Certificate),
+	}
+}
+
+// Set sets the certificate for the given alias
+func (c *Certificates) Set(alias string, cert *tls.Certificate) {
+	c.mu.Lock()
+	c.certs[alias] = cert
+	c.mu.Unlock()
+}
+
+// Load loads a certificate and key pair from the given files and sets it for
+// the given alias
+func (c *Certificates) Load(alias, certFile, keyFile string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	c.Set(alias, &cert)
+	return nil
+}
+
+// Remove removes the certificate for the given alias
+func (c *Certificates) Remove(alias string) {
+	c.mu.Lock()
+	delete(c.certs, alias)
+	c.mu.Unlock()
+}
+
+// Get returns the certificate that best matches the given server name
+func (c *Certificates) Get(serverName string) *tls.Certificate {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	var cert *tls.Certificate
+	matchAlias(serverName, func(alias string) bool {
+		cert = c.certs[alias]
+		return cert != nil
+	})
+	return cert
+}
+
+// GetCertificate can be used as the GetCertificate field of a tls.Config
+func (c *Certificates) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if cert := c.Get(strings.ToLower(hello.ServerName)); cert != nil {
+		return cert, nil
+	}
+	return nil, ErrNoCertificate
+}
+
+// Errors
+var (
+	ErrNoCertificate = errors.New("no certificate for server name")
+)
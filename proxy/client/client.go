@@ -0,0 +1,272 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// Client serves the connections passed to it by the proxy, on the proxied
+// HTTP and HTTPS listeners, with an http.Server
+type Client struct {
+	http, https net.Listener
+	server      *http.Server
+
+	mu                             sync.RWMutex
+	started, stopped, shuttingDown bool
+
+	wait         chan error
+	shutdownDone chan struct{}
+}
+
+// New creates a new Client that will serve connections from the given
+// listeners, either of which may be nil.
+//
+// Listeners created by the proxy will have their connections tracked for
+// Shutdown and Wait, and will shutdown the client when the proxy asks it to
+// drain.
+func New(httpSocket, httpsSocket net.Listener) *Client {
+	c := &Client{
+		http:         httpSocket,
+		https:        httpsSocket,
+		server:       new(http.Server),
+		wait:         make(chan error, 1),
+		shutdownDone: make(chan struct{}),
+	}
+	c.setDrain(httpSocket)
+	c.setDrain(httpsSocket)
+	return c
+}
+
+func (c *Client) setDrain(l net.Listener) {
+	if pl, ok := l.(*listener); ok {
+		pl.drain = c.drain
+	}
+}
+
+// Listeners returns the HTTP and HTTPS listeners of the client
+func (c *Client) Listeners() (net.Listener, net.Listener) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.http, c.https
+}
+
+// SetServer sets the http Server used to serve connections.
+//
+// If not set, an empty http.Server is used, which will serve requests with
+// the http.DefaultServeMux.
+func (c *Client) SetServer(s *http.Server) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.started {
+		return ErrRunning
+	}
+	if s == nil {
+		s = new(http.Server)
+	}
+	c.server = s
+	return nil
+}
+
+// Serve serves connections with the given handler, blocking until the client
+// stops and returning the error, if any.
+//
+// A nil handler leaves the Handler of the http Server unchanged.
+//
+// The proxy will hold connections for the client until it has been started.
+func (c *Client) Serve(handler http.Handler) error {
+	if err := c.start(handler); err != nil {
+		return err
+	}
+	go c.run()
+	return <-c.wait
+}
+
+// Start starts the client and returns immediately
+func (c *Client) Start(handler http.Handler) error {
+	if err := c.start(handler); err != nil {
+		return err
+	}
+	go c.run()
+	return nil
+}
+
+func (c *Client) start(handler http.Handler) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.started {
+		return ErrRunning
+	}
+	if c.stopped {
+		return ErrStopped
+	}
+	if c.http == nil && c.https == nil {
+		return ErrNoSocket
+	}
+	c.started = true
+	if handler != nil {
+		c.server.Handler = handler
+	}
+	c.server.ConnContext = connContext(c.server.ConnContext)
+	return nil
+}
+
+// run serves both listeners until the server stops, which happens for both
+// if either fails, and then sends the first error to Wait
+func (c *Client) run() {
+	ec := make(chan error, 2)
+	servers := 0
+	for _, l := range [...]net.Listener{c.http, c.https} {
+		if pl, ok := l.(*listener); ok {
+			pl.ready()
+		}
+	}
+	// Serve can set a TLSConfig on the server when configuring HTTP/2, so
+	// the HTTPS listener is chosen before either is served
+	https := c.https
+	if https != nil && c.server.TLSConfig != nil {
+		https = tls.NewListener(https, c.server.TLSConfig)
+	}
+	if c.http != nil {
+		servers++
+		go func() {
+			ec <- c.server.Serve(c.http)
+		}()
+	}
+	if https != nil {
+		servers++
+		go func() {
+			ec <- c.server.Serve(https)
+		}()
+	}
+	err := <-ec
+	if err != http.ErrServerClosed {
+		c.mu.Lock()
+		c.stopped = true
+		c.mu.Unlock()
+		c.server.Close()
+	}
+	for ; servers > 1; servers-- {
+		<-ec
+	}
+	if err == http.ErrServerClosed {
+		c.mu.RLock()
+		sd := c.shuttingDown
+		c.mu.RUnlock()
+		if sd {
+			<-c.shutdownDone
+			err = nil
+		}
+	}
+	if err != nil {
+		c.wait <- err
+	}
+	close(c.wait)
+}
+
+// drain gracefully stops the client when requested by the proxy, allowing
+// current requests to finish
+func (c *Client) drain() {
+	c.Shutdown(context.Background())
+}
+
+// Shutdown gracefully stops the client, closing the proxied listeners and then
+// waiting for all open connections to be closed, or for the context to be
+// done, in which case the context error is returned.
+//
+// Serve and Wait will return nil once the shutdown is complete.
+func (c *Client) Shutdown(ctx context.Context) error {
+	c.mu.Lock()
+	if c.stopped {
+		c.mu.Unlock()
+		return ErrStopped
+	}
+	c.stopped = true
+	s := c.started
+	c.shuttingDown = s
+	c.mu.Unlock()
+	if !s {
+		return c.closeListeners()
+	}
+	err := c.server.Shutdown(ctx)
+	if err == nil {
+		err = c.waitConnections(ctx)
+	}
+	close(c.shutdownDone)
+	return err
+}
+
+// waitConnections waits until all connections accepted from the proxied
+// listeners have been closed, or until the context is done
+func (c *Client) waitConnections(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		c.waitListeners()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *Client) waitListeners() {
+	for _, l := range [...]net.Listener{c.http, c.https} {
+		if pl, ok := l.(*listener); ok {
+			pl.conns.Wait()
+		}
+	}
+}
+
+// Wait waits for the client to stop and returns any error
+func (c *Client) Wait() error {
+	c.mu.RLock()
+	s := c.started
+	c.mu.RUnlock()
+	if !s {
+		return ErrNotRunning
+	}
+	err := <-c.wait
+	c.waitListeners()
+	return err
+}
+
+// Close closes all open proxied listeners and stops the client.
+//
+// Unlike Shutdown, active connections are closed immediately.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stopped {
+		return ErrStopped
+	}
+	c.stopped = true
+	if c.started {
+		// the server closes the listeners it is serving, so only errors
+		// for the others are returned
+		err := c.server.Close()
+		if e := c.closeListeners(); err == nil && !errors.Is(e, net.ErrClosed) {
+			err = e
+		}
+		return err
+	}
+	return nil
+}
+
+func (c *Client) closeListeners() error {
+	var err error
+	if c.http != nil {
+		err = c.http.Close()
+	}
+	if c.https != nil {
+		if e := c.https.Close(); err == nil {
+			err = e
+		}
+	}
+	return err
+}
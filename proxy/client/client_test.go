@@ -0,0 +1,271 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"vimagination.zapto.org/webserver/proxy/wire"
+)
+
+// proxyListener creates a listener as the proxy would pass to a client,
+// returning the proxy end of its socket
+func proxyListener(t *testing.T) (*net.UnixConn, net.Listener) {
+	t.Helper()
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatalf("unexpected error creating socket pair: %s", err)
+	}
+	f := os.NewFile(uintptr(fds[0]), "")
+	c, err := net.FileConn(f)
+	f.Close()
+	if err != nil {
+		t.Fatalf("unexpected error creating connection: %s", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	l, err := newListener(uintptr(fds[1]))
+	if err != nil {
+		t.Fatalf("unexpected error creating listener: %s", err)
+	}
+	return c.(*net.UnixConn), l
+}
+
+// passConn passes a new TCP connection to the client, returning the remote end
+func passConn(t *testing.T, u *net.UnixConn, hostname string) net.Conn {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error listening: %s", err)
+	}
+	defer l.Close()
+	remote, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("unexpected error dialling: %s", err)
+	}
+	t.Cleanup(func() { remote.Close() })
+	c, err := l.Accept()
+	if err != nil {
+		t.Fatalf("unexpected error accepting: %s", err)
+	}
+	defer c.Close()
+	f, err := c.(*net.TCPConn).File()
+	if err != nil {
+		t.Fatalf("unexpected error getting file: %s", err)
+	}
+	defer f.Close()
+	if err = wire.WriteConn(u, f, &wire.ConnInfo{Hostname: hostname}, nil); err != nil {
+		t.Fatalf("unexpected error passing connection: %s", err)
+	}
+	return remote
+}
+
+func readMessage(t *testing.T, u *net.UnixConn, typ wire.Type) {
+	t.Helper()
+	u.SetReadDeadline(time.Now().Add(5 * time.Second))
+	m, err := wire.Read(u)
+	if err != nil {
+		t.Fatalf("unexpected error reading message: %s", err)
+	} else if m.Type != typ {
+		t.Fatalf("expecting message type %d, got %d", typ, m.Type)
+	}
+}
+
+func get(t *testing.T, c net.Conn, close bool) string {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.Close = close
+	if err := req.Write(c); err != nil {
+		t.Fatalf("unexpected error writing request: %s", err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(c), req)
+	if err != nil {
+		t.Fatalf("unexpected error reading response: %s", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return string(body)
+}
+
+var hostnameHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	if info := ConnInfo(r); info != nil {
+		io.WriteString(w, info.Hostname)
+	}
+})
+
+func waitErr(t *testing.T, ec chan error) error {
+	t.Helper()
+	select {
+	case err := <-ec:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for client to stop")
+		return nil
+	}
+}
+
+func TestServeDrain(t *testing.T) {
+	u, l := proxyListener(t)
+	c := New(l, nil)
+	ec := make(chan error, 1)
+	go func() {
+		ec <- c.Serve(hostnameHandler)
+	}()
+	readMessage(t, u, wire.TypeReady)
+	remote := passConn(t, u, "example.com")
+	if body := get(t, remote, true); body != "example.com" {
+		t.Errorf("expecting body %q, got %q", "example.com", body)
+	}
+	readMessage(t, u, wire.TypeClosed)
+	if err := wire.WriteControl(u, wire.TypeDrain); err != nil {
+		t.Fatalf("unexpected error sending drain: %s", err)
+	}
+	if err := waitErr(t, ec); err != nil {
+		t.Errorf("unexpected error from Serve: %s", err)
+	}
+	if err := c.Shutdown(context.Background()); err != ErrStopped {
+		t.Errorf("expecting ErrStopped, got %v", err)
+	}
+}
+
+func TestStartShutdown(t *testing.T) {
+	httpU, httpL := proxyListener(t)
+	httpsU, httpsL := proxyListener(t)
+	c := New(httpL, httpsL)
+	if err := c.Wait(); err != ErrNotRunning {
+		t.Errorf("expecting ErrNotRunning before start, got %v", err)
+	}
+	if err := c.Start(hostnameHandler); err != nil {
+		t.Fatalf("unexpected error starting: %s", err)
+	}
+	if err := c.Start(nil); err != ErrRunning {
+		t.Errorf("expecting ErrRunning, got %v", err)
+	}
+	readMessage(t, httpU, wire.TypeReady)
+	readMessage(t, httpsU, wire.TypeReady)
+	remotes := [...]net.Conn{passConn(t, httpU, "a.example.com"), passConn(t, httpsU, "b.example.com")}
+	for n, expected := range [...]string{"a.example.com", "b.example.com"} {
+		if body := get(t, remotes[n], false); body != expected {
+			t.Errorf("expecting body %q, got %q", expected, body)
+		}
+	}
+	ec := make(chan error, 1)
+	go func() {
+		ec <- c.Wait()
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.Shutdown(ctx); err != nil {
+		t.Errorf("unexpected error shutting down: %s", err)
+	}
+	for n, remote := range remotes {
+		remote.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := remote.Read(make([]byte, 1)); err != io.EOF {
+			t.Errorf("connection %d: expecting connection to be closed, got %v", n+1, err)
+		}
+	}
+	if err := waitErr(t, ec); err != nil {
+		t.Errorf("unexpected error from Wait: %s", err)
+	}
+	if err := c.Start(nil); err != ErrRunning {
+		t.Errorf("expecting ErrRunning after shutdown, got %v", err)
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	u, l := proxyListener(t)
+	c := New(l, nil)
+	block, release := make(chan struct{}), make(chan struct{})
+	if err := c.Start(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(block)
+		<-release
+	})); err != nil {
+		t.Fatalf("unexpected error starting: %s", err)
+	}
+	readMessage(t, u, wire.TypeReady)
+	remote := passConn(t, u, "example.com")
+	if _, err := io.WriteString(remote, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"); err != nil {
+		t.Fatalf("unexpected error writing request: %s", err)
+	}
+	<-block
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := c.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expecting DeadlineExceeded, got %v", err)
+	}
+	close(release)
+	ec := make(chan error, 1)
+	go func() {
+		ec <- c.Wait()
+	}()
+	if err := waitErr(t, ec); err != nil {
+		t.Errorf("unexpected error from Wait: %s", err)
+	}
+}
+
+func TestShutdownNotStarted(t *testing.T) {
+	u, l := proxyListener(t)
+	c := New(l, nil)
+	if err := c.Shutdown(context.Background()); err != nil {
+		t.Errorf("unexpected error shutting down: %s", err)
+	}
+	u.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := wire.Read(u); err != io.EOF {
+		t.Errorf("expecting listener to be closed, got %v", err)
+	}
+	if err := c.Serve(nil); err != ErrStopped {
+		t.Errorf("expecting ErrStopped, got %v", err)
+	}
+	if err := New(nil, nil).Start(nil); err != ErrNoSocket {
+		t.Errorf("expecting ErrNoSocket, got %v", err)
+	}
+}
+
+func TestListenerFailure(t *testing.T) {
+	httpU, httpL := proxyListener(t)
+	httpsU, httpsL := proxyListener(t)
+	c := New(httpL, httpsL)
+	ec := make(chan error, 1)
+	go func() {
+		ec <- c.Serve(hostnameHandler)
+	}()
+	readMessage(t, httpU, wire.TypeReady)
+	readMessage(t, httpsU, wire.TypeReady)
+	httpsU.Close()
+	if err := waitErr(t, ec); err == nil || err == http.ErrServerClosed {
+		t.Errorf("expecting listener error, got %v", err)
+	}
+	httpU.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := wire.Read(httpU); err != io.EOF {
+		t.Errorf("expecting other listener to be closed, got %v", err)
+	}
+	if err := c.Shutdown(context.Background()); err != ErrStopped {
+		t.Errorf("expecting ErrStopped, got %v", err)
+	}
+}
+
+func TestStartClose(t *testing.T) {
+	u, l := proxyListener(t)
+	c := New(l, nil)
+	if err := c.Start(nil); err != nil {
+		t.Fatalf("unexpected error starting: %s", err)
+	}
+	readMessage(t, u, wire.TypeReady)
+	if err := c.Close(); err != nil {
+		t.Errorf("unexpected error closing: %s", err)
+	}
+	// with nothing waiting, the result of the client is kept for Wait
+	time.Sleep(100 * time.Millisecond)
+	ec := make(chan error, 1)
+	go func() {
+		ec <- c.Wait()
+	}()
+	if err := waitErr(t, ec); err != http.ErrServerClosed {
+		t.Errorf("expecting ErrServerClosed, got %v", err)
+	}
+}
@@ -0,0 +1,43 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+
+	"vimagination.zapto.org/webserver/proxy/wire"
+)
+
+type connInfoKey struct{}
+
+type infoConn interface {
+	ConnInfo() *wire.ConnInfo
+}
+
+// ConnInfo returns the information that the proxy sent along with the
+// connection the request was received on, such as the hostname used to route
+// it, the TLS server name, the listener that accepted it and the address of
+// the original peer.
+//
+// Returns nil if the connection did not come from the proxy.
+func ConnInfo(r *http.Request) *wire.ConnInfo {
+	info, _ := r.Context().Value(connInfoKey{}).(*wire.ConnInfo)
+	return info
+}
+
+func connContext(next func(context.Context, net.Conn) context.Context) func(context.Context, net.Conn) context.Context {
+	return func(ctx context.Context, c net.Conn) context.Context {
+		nc := c
+		if tc, ok := nc.(*tls.Conn); ok {
+			nc = tc.NetConn()
+		}
+		if ic, ok := nc.(infoConn); ok {
+			ctx = context.WithValue(ctx, connInfoKey{}, ic.ConnInfo())
+		}
+		if next != nil {
+			ctx = next(ctx, c)
+		}
+		return ctx
+	}
+}
@@ -1,24 +1,33 @@
 package client // import "vimagination.zapto.org/webserver/proxy/client"
 
 import (
-	"encoding/binary"
 	"errors"
 	"net"
 	"os"
-	"runtime"
 	"sync"
-	"syscall"
 	"time"
-)
 
-var openConnections sync.WaitGroup
+	"vimagination.zapto.org/webserver/proxy/wire"
+)
 
 type listener struct {
 	unix *net.UnixConn
+	// mu guards writes to the unix socket
+	mu sync.Mutex
+
+	// conns counts the connections accepted that have not yet been closed
+	conns sync.WaitGroup
+	// drain, if set, is called when the proxy asks the client to drain
+	drain func()
+
+	readyOnce sync.Once
+	readyErr  error
 }
 
 func newListener(socketFD uintptr) (net.Listener, error) {
-	c, err := net.FileConn(os.NewFile(socketFD, ""))
+	f := os.NewFile(socketFD, "")
+	c, err := net.FileConn(f)
+	f.Close()
 	if err != nil {
 		return nil, err
 	}
@@ -30,52 +39,46 @@ func newListener(socketFD uintptr) (net.Listener, error) {
 }
 
 func (l *listener) Accept() (net.Conn, error) {
-	length := make([]byte, 4)
-
-	oob := make([]byte, syscall.CmsgSpace(4))
-
-	_, _, _, _, err := l.unix.ReadMsgUnix(length, oob)
-	if err != nil {
+	if err := l.ready(); err != nil {
 		return nil, err
 	}
-	buf := make([]byte, binary.LittleEndian.Uint32(length))
-	if len(buf) > 0 {
-		_, err = l.unix.Read(buf)
+	for {
+		m, err := wire.Read(l.unix)
 		if err != nil {
 			return nil, err
 		}
+		if m.Type != wire.TypeConn {
+			if m.File != nil {
+				m.File.Close()
+			}
+			if m.Type == wire.TypeDrain && l.drain != nil {
+				go l.drain()
+			}
+			continue
+		}
+		c, err := net.FileConn(m.File)
+		m.File.Close()
+		if err != nil {
+			return nil, err
+		} else if c == nil {
+			return nil, ErrInvalidFDs
+		}
+		if ka, ok := c.(keepAlive); ok {
+			ka.SetKeepAlive(true)
+			ka.SetKeepAlivePeriod(3 * time.Minute)
+		}
+		buf := m.Data
+		if len(buf) == 0 {
+			buf = nil
+		}
+		l.conns.Add(1)
+		return &conn{
+			buf:  buf,
+			info: m.Info,
+			Conn: c,
+			done: l.closed,
+		}, nil
 	}
-	msg, err := syscall.ParseSocketControlMessage(oob)
-	if err != nil {
-		return nil, err
-	}
-	if len(msg) != 1 {
-		return nil, ErrInvalidSCM
-	}
-	fd, err := syscall.ParseUnixRights(&msg[0])
-	if err != nil {
-		return nil, err
-	}
-	if len(fd) != 1 {
-		return nil, ErrInvalidFDs
-	}
-	c, err := net.FileConn(os.NewFile(uintptr(fd[0]), ""))
-	if err != nil {
-		return nil, err
-	} else if c == nil {
-		return nil, ErrInvalidFDs
-	}
-	if ka, ok := c.(keepAlive); ok {
-		ka.SetKeepAlive(true)
-		ka.SetKeepAlivePeriod(3 * time.Minute)
-	}
-	conn := &conn{
-		buf:  buf,
-		Conn: c,
-	}
-	openConnections.Add(1)
-	runtime.SetFinalizer(conn, connClose)
-	return conn, nil
 }
 
 type keepAlive interface {
@@ -83,8 +86,24 @@ type keepAlive interface {
 	SetKeepAlivePeriod(time.Duration) error
 }
 
-func connClose(*conn) {
-	openConnections.Done()
+// ready tells the proxy that connections can now be accepted, doing so only
+// once
+func (l *listener) ready() error {
+	l.readyOnce.Do(func() {
+		l.mu.Lock()
+		l.readyErr = wire.WriteControl(l.unix, wire.TypeReady)
+		l.mu.Unlock()
+	})
+	return l.readyErr
+}
+
+// closed tells the proxy that a connection has been closed, and marks it as
+// finished
+func (l *listener) closed() {
+	l.mu.Lock()
+	wire.WriteControl(l.unix, wire.TypeClosed)
+	l.mu.Unlock()
+	l.conns.Done()
 }
 
 func (l *listener) Close() error {
@@ -96,9 +115,17 @@ func (l *listener) Addr() net.Addr {
 }
 
 type conn struct {
-	buf []byte
+	buf  []byte
+	info wire.ConnInfo
 	net.Conn
-	closed bool
+	done      func()
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// ConnInfo returns the information the proxy sent with the connection
+func (c *conn) ConnInfo() *wire.ConnInfo {
+	return &c.info
 }
 
 func (c *conn) Read(b []byte) (int, error) {
@@ -113,17 +140,19 @@ func (c *conn) Read(b []byte) (int, error) {
 	return n, nil
 }
 
+// Close closes the connection, marking it as finished for Wait and Shutdown
 func (c *conn) Close() error {
-	if c.closed {
-		return nil
-	}
-	runtime.SetFinalizer(c, nil)
-	connClose(nil)
-	c.closed = true
-	return c.Conn.Close()
+	c.closeOnce.Do(func() {
+		c.closeErr = c.Conn.Close()
+		c.done()
+	})
+	return c.closeErr
 }
 
 func (c *conn) RemoteAddr() net.Addr {
+	if c.info.RemoteAddr != nil {
+		return c.info.RemoteAddr
+	}
 	if c.Conn == nil {
 		return fakeAddr{}
 	}
@@ -135,6 +164,9 @@ func (c *conn) RemoteAddr() net.Addr {
 }
 
 func (c *conn) LocalAddr() net.Addr {
+	if c.info.LocalAddr != nil {
+		return c.info.LocalAddr
+	}
 	if c.Conn == nil {
 		return fakeAddr{}
 	}
@@ -158,6 +190,6 @@ func (fakeAddr) String() string {
 // Errors
 var (
 	ErrInvalidSocket = errors.New("invalid socket type")
-	ErrInvalidSCM    = errors.New("invalid number of socket control messages")
-	ErrInvalidFDs    = errors.New("invalid number of file descriptors")
+	ErrInvalidSCM    = wire.ErrInvalidSCM
+	ErrInvalidFDs    = wire.ErrInvalidFDs
 )
@@ -1,64 +1,119 @@
 package client
 
 import (
+	"context"
 	"crypto/tls"
 	"errors"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
-	"sync"
-)
-
-var (
-	proxyHTTPSocket, proxyHTTPSSocket net.Listener
-	server                            = new(http.Server)
-
-	mu               sync.RWMutex
-	started, stopped bool
+	"syscall"
 
-	wait = make(chan error)
+	"vimagination.zapto.org/webserver/proxy/activation"
 )
 
+// defaultClient is the Client used by the package level functions, using the
+// sockets passed to the process by the proxy or, when run without the proxy,
+// by systemd socket activation
+var defaultClient *Client
+
 func init() {
-	if hfd, ok := os.LookupEnv("proxyHTTPSocket"); ok {
-		fd, _ := strconv.ParseUint(hfd, 10, 0)
-		l, err := newListener(uintptr(fd))
-		if err == nil { // panic???
-			proxyHTTPSocket = l
-		}
-		os.Unsetenv("proxyHTTPSocket")
+	httpSocket, httpsSocket := socketListener("proxyHTTPSocket"), socketListener("proxyHTTPSSocket")
+	if httpSocket == nil && httpsSocket == nil {
+		httpSocket, httpsSocket, _ = activation.HTTP()
 	}
-	if sfd, ok := os.LookupEnv("proxyHTTPSSocket"); ok {
-		fd, _ := strconv.ParseUint(sfd, 10, 0)
-		l, err := newListener(uintptr(fd))
-		if err == nil { // panic???
-			proxyHTTPSSocket = l
+	defaultClient = New(httpSocket, httpsSocket)
+}
+
+// socketListener creates a listener from the socket whose file descriptor is
+// given in the named environment variable
+func socketListener(envName string) net.Listener {
+	sfd, ok := os.LookupEnv(envName)
+	if !ok {
+		return nil
+	}
+	os.Unsetenv(envName)
+	fd, _ := strconv.ParseUint(sfd, 10, 0)
+	l, err := newListener(uintptr(fd))
+	if err != nil { // panic???
+		return nil
+	}
+	return l
+}
+
+// handleSignals gracefully shuts down the default client when the process is
+// asked to stop, restoring the default behaviour of the signal if the client
+// is not running
+func handleSignals() {
+	sc := make(chan os.Signal, 1)
+	signal.Notify(sc, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-sc
+		signal.Stop(sc)
+		shutdownOnSignal(sig)
+	}()
+}
+
+func shutdownOnSignal(sig os.Signal) {
+	defaultClient.mu.RLock()
+	s := defaultClient.started && !defaultClient.stopped
+	defaultClient.mu.RUnlock()
+	if !s {
+		if p, err := os.FindProcess(os.Getpid()); err == nil {
+			p.Signal(sig)
 		}
-		os.Unsetenv("proxyHTTPSSocket")
+		return
 	}
-	// setup signals
+	defaultClient.Shutdown(context.Background())
+}
+
+// Default returns the Client used by the package level functions, which serves
+// the connections passed to the process by the proxy
+func Default() *Client {
+	return defaultClient
+}
+
+// HTTPListener returns the listener that receives the connections accepted by
+// the HTTP listener of the proxy, or nil if there is none.
+//
+// This allows servers other than http.Server to be used with the proxy. Any
+// bytes read by the proxy are replayed to the connection, and the proxy is
+// told that the process is ready on the first call to Accept. When the proxy
+// asks the process to drain, the listener is closed.
+func HTTPListener() net.Listener {
+	l, _ := defaultClient.Listeners()
+	return l
+}
+
+// HTTPSListener returns the listener that receives the connections accepted by
+// the HTTPS listener of the proxy, or nil if there is none.
+//
+// The connections are either still encrypted, or have been decrypted by the
+// proxy, as described by their connection information.
+//
+// See HTTPListener for more details.
+func HTTPSListener() net.Listener {
+	_, l := defaultClient.Listeners()
+	return l
 }
 
 // Setup will setup the client with the given http Server.
 //
 // This is optional as it will use the http DefaultServer by default
 func Setup(s *http.Server) error {
-	if started {
-		return ErrRunning
-	}
-	if proxyHTTPSocket == nil && proxyHTTPSSocket == nil {
+	if defaultClient.http == nil && defaultClient.https == nil {
 		return ErrNoSocket
 	}
-	if s == nil {
-		s = new(http.Server)
-	}
-	server = s
-	return nil
+	return defaultClient.SetServer(s)
 }
 
 // SetupTLS is used to setup the http Server and tls information
 func SetupTLS(s *http.Server, certFile, keyFile string) error {
+	defaultClient.mu.RLock()
+	started := defaultClient.started
+	defaultClient.mu.RUnlock()
 	if started {
 		return ErrRunning
 	}
@@ -82,118 +137,59 @@ func SetupTest(lnet, laddr string) error {
 	if err != nil {
 		return err
 	}
-	proxyHTTPSocket = l
-	return nil
-}
-
-func run() {
-	var wg sync.WaitGroup
-	mu.Lock()
-	started = true
-	mu.Unlock()
-	ec := make(chan error, 2)
-	if proxyHTTPSocket != nil {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			ec <- server.Serve(proxyHTTPSocket)
-		}()
-	}
-	if proxyHTTPSSocket != nil {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			if server.TLSConfig == nil {
-				ec <- server.Serve(proxyHTTPSSocket)
-			} else {
-				ec <- server.Serve(tls.NewListener(proxyHTTPSSocket, server.TLSConfig))
-			}
-
-		}()
-	}
-	wg.Wait()
-	close(ec)
-	err1 := <-ec
-	err2 := <-ec
-	if err1 != nil {
-		wait <- err1
-	} else if err2 != nil {
-		wait <- err2
+	defaultClient.mu.Lock()
+	defer defaultClient.mu.Unlock()
+	if defaultClient.started {
+		l.Close()
+		return ErrRunning
 	}
-	close(wait)
+	defaultClient.http = l
+	return nil
 }
 
 // Run starts the client and blocks until the client stops, returning the error
-// if any
+// if any.
+//
+// The proxy will hold connections for the client until it has been started.
+//
+// While the client is running, an interrupt or SIGTERM will gracefully shut it
+// down. Programs that handle these signals themselves should instead use the
+// methods of the Default Client, which leave signals alone.
 func Run() error {
-	mu.RLock()
-	s1 := started
-	s2 := stopped
-	mu.RUnlock()
-	if s1 {
-		return ErrRunning
-	}
-	if s2 {
-		return ErrStopped
-	}
-	go run()
-	return <-wait
+	handleSignals()
+	return defaultClient.Serve(nil)
 }
 
-// Start starts the client and returns immediately
+// Start starts the client and returns immediately.
+//
+// Signals are handled as with Run.
 func Start() error {
-	mu.RLock()
-	s1 := started
-	s2 := stopped
-	mu.RUnlock()
-	if s1 {
-		return ErrRunning
-	}
-	if s2 {
-		return ErrStopped
+	if err := defaultClient.Start(nil); err != nil {
+		return err
 	}
-	go run()
+	handleSignals()
 	return nil
 }
 
 // Wait waits for the client to stop and returns any error
 func Wait() error {
-	mu.RLock()
-	s := started
-	mu.RUnlock()
-	if !s {
-		return ErrNotRunning
-	}
-	err := <-wait
-	openConnections.Wait()
-	return err
+	return defaultClient.Wait()
 }
 
-// Close closes all open proxied listeners and stop the client
+// Shutdown gracefully stops the client, closing the proxied listeners and then
+// waiting for all open connections to be closed, or for the context to be
+// done, in which case the context error is returned.
+//
+// Run and Wait will return nil once the shutdown is complete.
+func Shutdown(ctx context.Context) error {
+	return defaultClient.Shutdown(ctx)
+}
+
+// Close closes all open proxied listeners and stop the client.
+//
+// Unlike Shutdown, active connections are closed immediately.
 func Close() error {
-	mu.Lock()
-	defer mu.Unlock()
-	if stopped {
-		return ErrStopped
-	}
-	stopped = true
-	if started {
-		err := server.Close()
-		if proxyHTTPSocket != nil {
-			e := proxyHTTPSocket.Close()
-			if err == nil {
-				err = e
-			}
-		}
-		if proxyHTTPSSocket != nil {
-			e := proxyHTTPSSocket.Close()
-			if err == nil {
-				err = e
-			}
-		}
-		return err
-	}
-	return nil
+	return defaultClient.Close()
 }
 
 // Errors
@@ -2,22 +2,28 @@ package proxy // import "vimagination.zapto.org/webserver/proxy"
 
 import (
 	"bytes"
+	"crypto/tls"
 	"io"
 	"net"
+	"net/url"
+	"path"
 	"strings"
 	"sync"
+	"time"
 
 	"vimagination.zapto.org/byteio"
 	"vimagination.zapto.org/memio"
+	"vimagination.zapto.org/webserver/proxy/wire"
 )
 
 // MaxHeaderSize represents the maximum size that the proxy will look throught to find a Host header
 const MaxHeaderSize = 8 << 10 // 8KB
 
-// Two preconstructed responses to certain errors
+// Preconstructed responses to certain errors
 var (
-	HeadersTooLarge = []byte("HTTP/1.0 413\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
-	BadRequest      = []byte("HTTP/1.0 400\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+	HeadersTooLarge    = []byte("HTTP/1.0 413\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+	BadRequest         = []byte("HTTP/1.0 400\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+	ServiceUnavailable = []byte("HTTP/1.0 503\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
 )
 
 var pool = sync.Pool{
@@ -31,26 +37,51 @@ func (p *Proxy) run(l net.Listener, encrypted bool) error {
 		c, err := l.Accept()
 		if err != nil {
 			if oe, ok := err.(*net.OpError); ok {
+				if oe.Timeout() && p.paused() {
+					continue
+				}
 				if oe.Temporary() {
 					continue
 				}
 			}
 			return err
 		}
-		go p.handleConn(c, encrypted)
+		p.active.Add(1)
+		go func(accepted time.Time) {
+			p.handleConn(c, encrypted, accepted)
+			p.active.Done()
+		}(time.Now())
 	}
 }
 
-func (p *Proxy) handleConn(c net.Conn, encrypted bool) {
+func (p *Proxy) handleConn(c net.Conn, encrypted bool, accepted time.Time) {
 	buf := pool.Get().(memio.Buffer)
 	defer pool.Put(buf)
 	defer c.Close()
 	var (
 		hostname   string
 		readLength int
+		info       = wire.ConnInfo{
+			Listener:   wire.ListenerHTTP,
+			Accepted:   accepted,
+			RemoteAddr: c.RemoteAddr(),
+			LocalAddr:  c.LocalAddr(),
+		}
 	)
+	if p.trusted(encrypted, c.RemoteAddr()) {
+		remote, local, err := readProxyHeader(c)
+		if err != nil {
+			return
+		}
+		if remote != nil {
+			info.RemoteAddr = remote
+			info.LocalAddr = local
+		}
+	}
 	if encrypted {
-		hostname, readLength = readEncrypted(c, buf)
+		info.Listener = wire.ListenerHTTPS
+		hostname, info.ALPN, readLength = readEncrypted(c, buf)
+		info.ServerName = hostname
 	} else {
 		hostname, readLength = readHTTP(c, buf)
 	}
@@ -59,6 +90,8 @@ func (p *Proxy) handleConn(c net.Conn, encrypted bool) {
 		return
 	}
 
+	// a request without a Host header, such as an HTTP/1.0 request or the
+	// HTTP/2 connection preface, is sent to the default host
 	if readLength < 0 {
 		c.Write(BadRequest)
 		return
@@ -68,28 +101,149 @@ func (p *Proxy) handleConn(c net.Conn, encrypted bool) {
 	if pos >= 0 {
 		hostname = hostname[:pos]
 	}
+	hostname = strings.ToLower(hostname)
+
+	var path string
+	if !encrypted {
+		path = requestPath(buf[:readLength])
+	}
+	h, alias := p.getHost(hostname, path)
+	info.Hostname = hostname
+	info.Alias = alias
+	if p.challenges != nil && strings.HasPrefix(path, acmeChallengePath) && h.getTLSConfig() != nil {
+		p.challenges.serve(c, buf[:readLength])
+		return
+	}
+	if p.mode(encrypted) == ModeReverseProxy {
+		if !encrypted {
+			p.reverseConn(c, buf[:readLength], &info, nil)
+			return
+		} else if config := h.getReverseTLSConfig(); config != nil {
+			p.reverseConn(c, buf[:readLength], &info, config)
+			return
+		}
+	}
+	for {
+		target, status := h.route()
+		if target == nil {
+			if !encrypted {
+				c.Write(statusResponse(status))
+			}
+			return
+		}
+		tlsConfig := target.getTLSConfig()
+		pr, err := target.getProcess()
+		if err != nil {
+			// the host went idle after being routed to and could not
+			// be started again, which route will find
+			continue
+		} else if pr == nil {
+			target.setHealthy(false, ErrNotRunning)
+			continue
+		}
+		t := pr.getTransfer(encrypted && tlsConfig == nil)
+		if err := target.waitReady(pr, t); err != nil {
+			target.instanceFailed(pr, err)
+			continue
+		}
+		if encrypted && tlsConfig != nil {
+			err = terminateTLS(c, buf[:readLength], tlsConfig, t, &info)
+		} else {
+			err = t.Transfer(c, buf[:readLength], &info)
+		}
+		if err == nil {
+			return
+		} else if !isSocketError(err) {
+			p.logf("host %s: error passing connection: %s\n", target.name, err)
+			return
+		}
+		target.instanceFailed(pr, err)
+		if encrypted && tlsConfig != nil {
+			return
+		}
+	}
+}
+
+// terminateTLS completes the TLS handshake with the client and passes the
+// decrypted stream to the host, copying data between the two until both
+// sides have closed.
+//
+// An error is only returned when the stream could not be passed to the host,
+// after which the connection cannot be passed to another instance, as the
+// handshake has already been completed.
+func terminateTLS(c net.Conn, buf []byte, config *tls.Config, t *transfer, info *wire.ConnInfo) error {
+	tc := tls.Server(&peekedConn{Conn: c, buf: buf}, config)
+	if err := tc.Handshake(); err != nil {
+		return nil
+	}
+	defer tc.Close()
+	local, remote, err := socketPair()
+	if err != nil {
+		return err
+	}
+	defer local.Close()
+	info.TLS = true
+	err = t.Transfer(remote, nil, info)
+	remote.Close()
+	if err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	go func() {
+		copyHalf(local, tc)
+		close(done)
+	}()
+	copyHalf(tc, local)
+	<-done
+	return nil
+}
+
+// halfCloser is a connection that can be closed for writing while still
+// being read from
+type halfCloser interface {
+	net.Conn
+	CloseWrite() error
+}
+
+// copyHalf copies from b to a until b is closed, at which point the writing
+// side of a is closed so that the other direction can finish. If the copy
+// fails, both connections are closed.
+func copyHalf(a, b halfCloser) {
+	if _, err := io.Copy(a, b); err == nil {
+		a.CloseWrite()
+	} else {
+		a.Close()
+		b.Close()
+	}
+}
+
+// peekedConn is a net.Conn that returns the already read bytes before reading
+// from the underlying connection
+type peekedConn struct {
+	net.Conn
+	buf []byte
+}
 
-	p.mu.RLock()
-	h, ok := p.hostnames[hostname]
-	if !ok {
-		h = p.defaultHost
+func (p *peekedConn) Read(b []byte) (int, error) {
+	if len(p.buf) == 0 {
+		return p.Conn.Read(b)
 	}
-	p.mu.RUnlock()
-	t := h.getTransfer(encrypted)
-	t.Transfer(c, buf[:readLength])
+	n := copy(b, p.buf)
+	p.buf = p.buf[n:]
+	return n, nil
 }
 
-func readEncrypted(c io.Reader, buf memio.Buffer) (string, int) {
+func readEncrypted(c io.Reader, buf memio.Buffer) (string, []string, int) {
 	_, err := io.ReadFull(c, buf[:5])
 	if err != nil {
-		return "", -1
+		return "", nil, -1
 	}
 	r := byteio.StickyBigEndianReader{
 		Reader: &buf,
 	}
 	if r.ReadUint8() != 22 {
 		//not a handshake, error out
-		return "", -1
+		return "", nil, -1
 	}
 
 	buf = buf[1:] // skip major version
@@ -98,23 +252,23 @@ func readEncrypted(c io.Reader, buf memio.Buffer) (string, int) {
 	length := r.ReadUint16()
 
 	if len(buf) < int(length) {
-		return "", -1
+		return "", nil, -1
 	}
 	buf = buf[:length]
 	_, err = io.ReadFull(c, buf)
 	if err != nil {
-		return "", -1
+		return "", nil, -1
 	}
 
 	if r.ReadUint8() != 1 {
 		// not a client_hello, error out
-		return "", -1
+		return "", nil, -1
 	}
 
 	l := int(r.ReadUint24())
 	if l != len(buf) {
 		// incorrect length
-		return "", -1
+		return "", nil, -1
 	}
 
 	buf = buf[1:] // skip major version
@@ -126,43 +280,50 @@ func readEncrypted(c io.Reader, buf memio.Buffer) (string, int) {
 	sessionLength := r.ReadUint8()
 	if sessionLength > 32 || len(buf) < int(sessionLength) {
 		// invalid length
-		return "", -1
+		return "", nil, -1
 	}
 	buf = buf[sessionLength:] // skip session id
 
 	cipherSuiteLength := r.ReadUint16()
 	if cipherSuiteLength == 0 || len(buf) < int(cipherSuiteLength) {
 		// invalid length
-		return "", -1
+		return "", nil, -1
 	}
 	buf = buf[cipherSuiteLength:] // skip cipher suites
 
 	compressionMethodLength := r.ReadUint8()
 	if compressionMethodLength < 1 {
 		// invalid length
-		return "", -1
+		return "", nil, -1
 	}
 	buf = buf[compressionMethodLength:] // skip compression methods
 
 	extsLength := r.ReadUint16()
 	if len(buf) < int(extsLength) {
 		// invalid length
-		return "", -1
+		return "", nil, -1
 	}
 	buf = buf[:extsLength]
 
+	var (
+		serverName string
+		alpn       []string
+	)
 	for len(buf) > 0 {
 		extType := r.ReadUint16()
 		extLength := r.ReadUint16()
 		if len(buf) < int(extLength) {
 			// invalid length
-			return "", -1
+			return "", nil, -1
 		}
-		if extType == 0 { // server_name
+		next := buf[extLength:]
+		buf = buf[:extLength]
+		switch extType {
+		case 0: // server_name
 			l := r.ReadUint16()
-			if l != extLength-2 {
+			if l != extLength-2 || len(buf) < 3 {
 				// invalid length
-				return "", -1
+				return "", nil, -1
 			}
 
 			buf = buf[1:] // skip name_type
@@ -170,13 +331,59 @@ func readEncrypted(c io.Reader, buf memio.Buffer) (string, int) {
 			nameLength := r.ReadUint16()
 			if len(buf) < int(nameLength) {
 				// invalid length
-				return "", -1
+				return "", nil, -1
+			}
+			serverName = string(buf[:nameLength])
+		case 16: // application_layer_protocol_negotiation
+			l := r.ReadUint16()
+			if l != extLength-2 {
+				// invalid length
+				return "", nil, -1
+			}
+			for len(buf) > 0 {
+				protoLength := r.ReadUint8()
+				if protoLength == 0 || len(buf) < int(protoLength) {
+					// invalid length
+					return "", nil, -1
+				}
+				alpn = append(alpn, string(buf[:protoLength]))
+				buf = buf[protoLength:]
 			}
-			return string(buf[:nameLength]), 5 + int(length)
 		}
-		buf = buf[extLength:]
+		buf = next
+	}
+	return serverName, alpn, 5 + int(length)
+}
+
+// requestPath returns the path from the request line at the start of the
+// buffer, which may be in origin or absolute form, cleaned with cleanPath
+func requestPath(buf []byte) string {
+	if p := bytes.IndexByte(buf, '\n'); p >= 0 {
+		buf = buf[:p]
+	}
+	fields := bytes.Fields(buf)
+	if len(fields) != 3 {
+		return ""
+	}
+	u, err := url.ParseRequestURI(string(fields[1]))
+	if err != nil {
+		return ""
+	}
+	return cleanPath(u.Path)
+}
+
+// cleanPath returns the shortest equivalent of the decoded request path, as
+// path.Clean, keeping any trailing slash, so that it can be matched against
+// path prefix routes
+func cleanPath(p string) string {
+	if !strings.HasPrefix(p, "/") {
+		return ""
+	}
+	cleaned := path.Clean(p)
+	if strings.HasSuffix(p, "/") && cleaned != "/" {
+		cleaned += "/"
 	}
-	return "", 5 + int(length)
+	return cleaned
 }
 
 func readHTTP(c io.Reader, buf []byte) (string, int) {
@@ -202,7 +409,7 @@ func readHTTP(c io.Reader, buf []byte) (string, int) {
 		}
 		line := buf[last:]
 		if len(line) == 2 && line[0] == '\r' && line[1] == '\n' {
-			break
+			return "", readLength
 		}
 		last = len(buf)
 		p := bytes.IndexByte(line, ':')
@@ -0,0 +1,213 @@
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"vimagination.zapto.org/webserver/proxy/wire"
+)
+
+func testCertificate(t *testing.T, names ...string) *tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("unexpected error generating key: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("unexpected error creating certificate: %s", err)
+	}
+	return &tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+	}
+}
+
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error listening: %s", err)
+	}
+	defer l.Close()
+	a, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("unexpected error dialing: %s", err)
+	}
+	b, err := l.Accept()
+	if err != nil {
+		t.Fatalf("unexpected error accepting: %s", err)
+	}
+	return a, b
+}
+
+func TestTerminateTLSHalfClose(t *testing.T) {
+	tr, err := newTransfer()
+	if err != nil {
+		t.Fatalf("unexpected error creating transfer: %s", err)
+	}
+	defer tr.Close()
+	fc, err := net.FileConn(tr.f)
+	if err != nil {
+		t.Fatalf("unexpected error opening child socket: %s", err)
+	}
+	defer fc.Close()
+	tr.started()
+	hostErr := make(chan error, 1)
+	go func() {
+		m, err := wire.Read(fc.(*net.UnixConn))
+		if err != nil {
+			hostErr <- err
+			return
+		}
+		c, err := net.FileConn(m.File)
+		m.File.Close()
+		if err != nil {
+			hostErr <- err
+			return
+		}
+		defer c.Close()
+		if !m.Info.TLS {
+			hostErr <- io.ErrUnexpectedEOF
+			return
+		}
+		// only respond once the client has finished sending
+		if _, err = io.ReadAll(c); err != nil {
+			hostErr <- err
+			return
+		}
+		_, err = c.Write([]byte("pong"))
+		hostErr <- err
+	}()
+	client, server := tcpPair(t)
+	defer client.Close()
+	config := &tls.Config{
+		Certificates: []tls.Certificate{*testCertificate(t, "example.com")},
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- terminateTLS(server, nil, config, tr, &wire.ConnInfo{})
+		server.Close()
+	}()
+	tc := tls.Client(client, &tls.Config{InsecureSkipVerify: true})
+	if _, err = tc.Write([]byte("ping")); err != nil {
+		t.Fatalf("unexpected error writing: %s", err)
+	}
+	if err = tc.CloseWrite(); err != nil {
+		t.Fatalf("unexpected error closing for writing: %s", err)
+	}
+	tc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	data, err := io.ReadAll(tc)
+	if err != nil {
+		t.Fatalf("unexpected error reading: %s", err)
+	} else if string(data) != "pong" {
+		t.Errorf("expecting to read %q, got %q", "pong", data)
+	}
+	if err = <-hostErr; err != nil {
+		t.Errorf("unexpected host error: %s", err)
+	}
+	if err = <-done; err != nil {
+		t.Errorf("unexpected error from terminateTLS: %s", err)
+	}
+}
+
+// transferHost creates a host with a single ready instance, returning the end
+// of its HTTP transfer socket that the process would read
+func transferHost(t *testing.T, p *Proxy, name string, aliases ...string) (*Host, *net.UnixConn) {
+	t.Helper()
+	h := newTestHost(t, p, name, aliases...)
+	tr, err := newTransfer()
+	if err != nil {
+		t.Fatalf("unexpected error creating transfer: %s", err)
+	}
+	t.Cleanup(func() { tr.Close() })
+	fc, err := net.FileConn(tr.f)
+	if err != nil {
+		t.Fatalf("unexpected error opening child socket: %s", err)
+	}
+	t.Cleanup(func() { fc.Close() })
+	tr.started()
+	tr.markReady()
+	pr := newTestProcess()
+	pr.httpTransfer = tr
+	h.procs = []*process{pr}
+	return h, fc.(*net.UnixConn)
+}
+
+func TestHandleHostname(t *testing.T) {
+	p := newTestProxy(t)
+	def, defConn := transferHost(t, p, "default")
+	p.Default(def)
+	_, wwwConn := transferHost(t, p, "www", "www.example.com")
+	for n, test := range [...]struct {
+		Request  string
+		Conn     *net.UnixConn
+		Hostname string
+	}{
+		{"GET / HTTP/1.0\r\n\r\n", defConn, ""},
+		{"GET / HTTP/1.0\r\nUser-Agent: test\r\n\r\n", defConn, ""},
+		{"GET / HTTP/1.1\r\nHost: www.example.com\r\n\r\n", wwwConn, "www.example.com"},
+		{"GET / HTTP/1.1\r\nHost: WWW.Example.COM:8080\r\n\r\n", wwwConn, "www.example.com"},
+		{"GET / HTTP/1.1\r\nHost: other.example.com\r\n\r\n", defConn, "other.example.com"},
+	} {
+		client, server := tcpPair(t)
+		done := make(chan struct{})
+		go func() {
+			p.handleConn(server, false, time.Now())
+			close(done)
+		}()
+		if _, err := io.WriteString(client, test.Request); err != nil {
+			t.Fatalf("test %d: unexpected error writing request: %s", n+1, err)
+		}
+		test.Conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		m, err := wire.Read(test.Conn)
+		if err != nil {
+			t.Errorf("test %d: unexpected error reading transferred connection: %s", n+1, err)
+		} else {
+			m.File.Close()
+			if m.Info.Hostname != test.Hostname {
+				t.Errorf("test %d: expecting hostname %q, got %q", n+1, test.Hostname, m.Info.Hostname)
+			}
+			if len(m.Data) == 0 || !strings.HasPrefix(test.Request, string(m.Data)) {
+				t.Errorf("test %d: expecting data to be read from %q, got %q", n+1, test.Request, m.Data)
+			}
+		}
+		client.Close()
+		<-done
+	}
+}
+
+func TestHandleBadRequest(t *testing.T) {
+	p := newTestProxy(t)
+	def, _ := transferHost(t, p, "default")
+	p.Default(def)
+	client, server := tcpPair(t)
+	go p.handleConn(server, false, time.Now())
+	io.WriteString(client, "GET / HTTP/1.0\r\n")
+	client.(*net.TCPConn).CloseWrite()
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	data, err := io.ReadAll(client)
+	if err != nil {
+		t.Fatalf("unexpected error reading response: %s", err)
+	} else if !strings.HasPrefix(string(data), "HTTP/1.0 400") {
+		t.Errorf("expecting bad request response, got %q", data)
+	}
+	client.Close()
+}
@@ -0,0 +1,269 @@
+package proxy
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"vimagination.zapto.org/webserver/proxy/wire"
+)
+
+// HealthCheck configures how the health of a host is checked, and what
+// happens to its connections while it is unhealthy.
+//
+// Active checks are made against each instance of the host, with failing
+// instances being taken out of rotation, and the host being unhealthy while
+// none of its instances are in rotation. In addition, an instance is taken out
+// of rotation whenever a connection cannot be passed to it. An instance is
+// returned to rotation after a successful active check, or when its process is
+// restarted. Without active checks, an instance is returned to rotation
+// Interval after a connection could not be passed to it.
+type HealthCheck struct {
+	// Path, if set, will be requested from the host over its HTTP socket,
+	// with any response other than a 4xx or 5xx being a success
+	Path string
+	// Addr, if set, will be dialled over TCP, with a successful connection
+	// being a success
+	Addr string
+	// Interval is the time between active checks, and Timeout is the time
+	// allowed for each check to complete
+	Interval, Timeout time.Duration
+	// Failures is the number of consecutive failed active checks before an
+	// instance is taken out of rotation
+	Failures int
+	// Fallback, if set, is the host that will receive connections while
+	// this host is unhealthy
+	Fallback *Host
+	// Status is the HTTP status code returned to HTTP connections while
+	// this host is unhealthy and there is no healthy Fallback
+	Status int
+}
+
+// Default health check values
+const (
+	DefaultHealthInterval = 10 * time.Second
+	DefaultHealthTimeout  = 5 * time.Second
+	DefaultHealthFailures = 3
+)
+
+// maxFallbacks limits how many fallback hosts will be followed, guarding
+// against fallback loops
+const maxFallbacks = 8
+
+func statusResponse(status int) []byte {
+	return []byte("HTTP/1.0 " + strconv.Itoa(status) + "\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+}
+
+// SetHealthCheck sets the health checking for the host, starting any active
+// checks and stopping any previous ones.
+//
+// The Fallback, if set, must be a host of the same proxy that has not been
+// removed.
+func (h *Host) SetHealthCheck(hc HealthCheck) error {
+	if hc.Fallback != nil && hc.Fallback.proxy != h.proxy {
+		return ErrInvalidHost
+	}
+	if hc.Interval <= 0 {
+		hc.Interval = DefaultHealthInterval
+	}
+	if hc.Timeout <= 0 {
+		hc.Timeout = DefaultHealthTimeout
+	}
+	if hc.Failures <= 0 {
+		hc.Failures = DefaultHealthFailures
+	}
+	if hc.Status == 0 {
+		hc.Status = http.StatusServiceUnavailable
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	// checked with the lock held, so that a concurrent RemoveHost either
+	// fails this check or clears the fallback once it is set
+	if hc.Fallback != nil && h.proxy.Host(hc.Fallback.name) != hc.Fallback {
+		return ErrInvalidHost
+	}
+	if h.healthStop != nil {
+		close(h.healthStop)
+		h.healthStop = nil
+	}
+	h.health = hc
+	if hc.Path != "" || hc.Addr != "" {
+		h.healthStop = make(chan struct{})
+		go h.checkHealth(hc, h.healthStop)
+	} else {
+		// nothing would return instances taken out of rotation by
+		// previous active checks
+		for _, pr := range h.procs {
+			if pr.unhealthy && pr.ready() {
+				h.setInstanceHealthyLocked(pr, true, nil)
+			}
+		}
+	}
+	return nil
+}
+
+// Healthy returns whether the host is currently considered healthy
+func (h *Host) Healthy() bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return !h.unhealthy
+}
+
+func (h *Host) setHealthy(healthy bool, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.setHealthyLocked(healthy, err)
+}
+
+func (h *Host) setHealthyLocked(healthy bool, err error) {
+	if healthy == !h.unhealthy {
+		return
+	}
+	h.unhealthy = !healthy
+	if healthy {
+		h.proxy.logf("host %s is healthy\n", h.name)
+	} else {
+		h.proxy.logf("host %s is unhealthy: %s\n", h.name, err)
+	}
+}
+
+// route returns the host that should receive connections for this host,
+// following fallbacks while hosts are unhealthy.
+//
+// Idle hosts are started on the way, with a host that fails to start being
+// passed over for this connection only, remaining idle and healthy so that the
+// next connection tries to start it again.
+//
+// When no host is available, the status to send to HTTP clients is returned
+// instead.
+func (h *Host) route() (*Host, int) {
+	status := http.StatusServiceUnavailable
+	for i := 0; i < maxFallbacks && h != nil; i++ {
+		h.mu.RLock()
+		unhealthy, idle, fallback := h.unhealthy, h.idle, h.health.Fallback
+		if h.health.Status != 0 {
+			status = h.health.Status
+		}
+		h.mu.RUnlock()
+		if !unhealthy && (!idle || h.wake() == nil) {
+			return h, 0
+		}
+		h = fallback
+	}
+	return nil, status
+}
+
+func (h *Host) checkHealth(hc HealthCheck, stop chan struct{}) {
+	t := time.NewTicker(hc.Interval)
+	defer t.Stop()
+	failures := make(map[*process]int)
+	for {
+		select {
+		case <-t.C:
+		case <-stop:
+			return
+		case <-h.proxy.closed:
+			return
+		}
+		var tcpErr error
+		if hc.Addr != "" {
+			tcpErr = checkTCP(hc.Addr, hc.Timeout)
+		}
+		prs := h.processes()
+		current := make(map[*process]int, len(prs))
+		for _, pr := range prs {
+			if pr.exited() {
+				continue
+			}
+			var err error
+			if hc.Path != "" {
+				err = h.checkHTTP(pr, hc.Path, hc.Timeout)
+			}
+			if err == nil {
+				err = tcpErr
+			}
+			if err == nil {
+				h.setInstanceHealthy(pr, true, nil)
+			} else if current[pr] = failures[pr] + 1; current[pr] >= hc.Failures {
+				h.setInstanceHealthy(pr, false, err)
+			}
+		}
+		failures = current
+	}
+}
+
+// checkHTTP requests the path from an instance of the host, over a connection
+// passed to it as if it had come from the HTTP listener
+func (h *Host) checkHTTP(pr *process, path string, timeout time.Duration) error {
+	t := pr.getTransfer(false)
+	if t == nil {
+		return ErrNotRunning
+	}
+	local, remote, err := socketPair()
+	if err != nil {
+		return err
+	}
+	defer local.Close()
+	hostname := "localhost"
+	for _, alias := range h.Aliases() {
+		if alias, _ = splitRoute(alias); isHostname(alias) {
+			hostname = alias
+			break
+		}
+	}
+	err = t.Transfer(remote, nil, &wire.ConnInfo{
+		Listener:   wire.ListenerHTTP,
+		Hostname:   hostname,
+		Accepted:   time.Now(),
+		RemoteAddr: local.LocalAddr(),
+		LocalAddr:  local.LocalAddr(),
+	})
+	remote.Close()
+	if err != nil {
+		return err
+	}
+	local.SetDeadline(time.Now().Add(timeout))
+	req, err := http.NewRequest(http.MethodGet, path, nil)
+	if err != nil {
+		return err
+	}
+	req.Host = hostname
+	req.Close = true
+	if err = req.Write(local); err != nil {
+		return err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(local), req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return ErrUnhealthyResponse{resp.StatusCode}
+	}
+	return nil
+}
+
+func checkTCP(addr string, timeout time.Duration) error {
+	c, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return err
+	}
+	return c.Close()
+}
+
+func isHostname(alias string) bool {
+	_, _, wildcard := splitAlias(alias)
+	return !wildcard
+}
+
+// ErrUnhealthyResponse is an error returned from an HTTP health check when the
+// host responds with an error status
+type ErrUnhealthyResponse struct {
+	Status int
+}
+
+func (e ErrUnhealthyResponse) Error() string {
+	return "health check returned status " + strconv.Itoa(e.Status)
+}
@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+func newTestProcess() *process {
+	return &process{
+		cmd: &exec.Cmd{
+			Process: &os.Process{Pid: 1},
+		},
+		started: time.Now(),
+		done:    make(chan struct{}),
+	}
+}
+
+func TestPassiveRecovery(t *testing.T) {
+	p := newTestProxy(t)
+	for n, test := range [...]struct {
+		Active  bool
+		Healthy bool
+	}{
+		{false, true},
+		{true, false},
+	} {
+		h := &Host{
+			proxy: p,
+			name:  "host",
+			procs: []*process{newTestProcess()},
+			health: HealthCheck{
+				Interval: 10 * time.Millisecond,
+			},
+		}
+		if test.Active {
+			h.healthStop = make(chan struct{})
+		}
+		h.instanceFailed(h.procs[0], errors.New("broken pipe"))
+		if h.Healthy() {
+			t.Errorf("test %d: expecting host to be unhealthy after a failed connection", n+1)
+			continue
+		}
+		time.Sleep(100 * time.Millisecond)
+		if healthy := h.Healthy(); healthy != test.Healthy {
+			t.Errorf("test %d: expecting healthy %v, got %v", n+1, test.Healthy, healthy)
+		}
+		if pr, _ := h.getProcess(); (pr != nil) != test.Healthy {
+			t.Errorf("test %d: expecting instance in rotation %v, got %v", n+1, test.Healthy, pr != nil)
+		}
+	}
+}
+
+func TestRemoveFallback(t *testing.T) {
+	p := newTestProxy(t)
+	a := newTestHost(t, p, "a")
+	b := newTestHost(t, p, "b")
+	c := newTestHost(t, p, "c")
+	if err := a.SetHealthCheck(HealthCheck{Fallback: b}); err != nil {
+		t.Fatalf("unexpected error setting health check: %s", err)
+	}
+	if err := c.SetHealthCheck(HealthCheck{Fallback: a}); err != nil {
+		t.Fatalf("unexpected error setting health check: %s", err)
+	}
+	if err := p.RemoveHost(b); err != nil {
+		t.Fatalf("unexpected error removing host: %s", err)
+	}
+	for n, test := range [...]struct {
+		Host, Fallback *Host
+	}{
+		{a, nil},
+		{c, a},
+	} {
+		test.Host.mu.RLock()
+		fallback := test.Host.health.Fallback
+		test.Host.mu.RUnlock()
+		if fallback != test.Fallback {
+			t.Errorf("test %d: expecting fallback %v, got %v", n+1, test.Fallback, fallback)
+		}
+	}
+	if err := a.SetHealthCheck(HealthCheck{Fallback: b}); err != ErrInvalidHost {
+		t.Errorf("expecting ErrInvalidHost setting removed fallback, got %v", err)
+	}
+}
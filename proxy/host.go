@@ -1,41 +1,152 @@
 package proxy
 
 import (
+	"crypto/tls"
 	"errors"
+	"hash/fnv"
+	"io"
+	"net/http/httputil"
+	"os"
 	"os/exec"
 	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // Host represents a single host and its aliases
 type Host struct {
 	proxy *Proxy
+	name  string
 
-	mu                          sync.RWMutex
-	cmd                         *exec.Cmd
-	aliases                     []string
-	httpTransfer, httpsTransfer *transfer
+	mu        sync.RWMutex
+	template  *exec.Cmd
+	procs     []*process
+	instances int
+	balance   Balance
+	next      atomic.Uint32
+	stopped   bool
+	idle      bool
+	removed   bool
+	aliases   []string
+	policy    RestartPolicy
+	restarts  []time.Time
+
+	// reverseTLSConfig is tlsConfig with the protocols served in
+	// ModeReverseProxy
+	tlsConfig, reverseTLSConfig *tls.Config
+
+	startTimeout, drainTimeout time.Duration
+	noReadiness                atomic.Bool
+
+	health     HealthCheck
+	healthStop chan struct{}
+	unhealthy  bool
+
+	idleStop chan struct{}
+	lastUsed atomic.Int64
+
+	cgroup string
+	limits atomic.Pointer[Limits]
+
+	reverse [2]*httputil.ReverseProxy
 }
 
 // NewHost creates a new Host from the given command, setting up the proxied
-// connections and running the command
+// connections and running the command.
+//
+// The host is given a name generated from the command, which is the same each
+// time the same commands are given in the same order, so that the host keeps
+// its name, and its processes, across an Upgrade.
 func (p *Proxy) NewHost(c *exec.Cmd) (*Host, error) {
+	return p.newHost("", c, false)
+}
+
+// NewNamedHost creates a new Host from the given command, as NewHost, with
+// the given name.
+//
+// The name identifies the host to the proxy, and must be unique among its
+// hosts.
+func (p *Proxy) NewNamedHost(name string, c *exec.Cmd) (*Host, error) {
+	if name == "" {
+		return nil, ErrInvalidName
+	}
+	return p.newHost(name, c, false)
+}
+
+func (p *Proxy) newHost(name string, c *exec.Cmd, onDemand bool) (*Host, error) {
 	h := &Host{
-		cmd:   c,
-		proxy: p,
+		template:     copyCmd(c),
+		proxy:        p,
+		name:         name,
+		instances:    1,
+		startTimeout: DefaultStartTimeout,
+		drainTimeout: DefaultDrainTimeout,
+	}
+	if name != "" {
+		if !p.addHost(h) {
+			return nil, ErrHostExists{name}
+		}
+	} else {
+		base := commandName(c)
+		h.name = base
+		for n := 2; !p.addHost(h); n++ {
+			h.name = base + "-" + strconv.Itoa(n)
+		}
+	}
+	if err := h.createCgroup(); err != nil {
+		p.removeHost(h)
+		return nil, err
+	}
+	h.used()
+	prs := h.inherit(c)
+	if len(prs) == 0 && onDemand {
+		h.idle = true
+		return h, nil
 	}
 	var err error
-	h.httpTransfer, h.httpsTransfer, err = h.setupCmd(c)
+	if len(prs) == 0 {
+		var pr *process
+		if pr, err = h.setupCmd(c); err == nil {
+			prs = append(prs, pr)
+		}
+	}
+	if err == nil {
+		h.mu.Lock()
+		h.instances = len(prs)
+		err = h.setProcesses(prs)
+		h.mu.Unlock()
+	}
 	if err != nil {
+		p.removeHost(h)
 		return nil, err
 	}
 	return h, nil
 }
 
-func (h *Host) setupCmd(c *exec.Cmd) (*transfer, *transfer, error) {
+// Name returns the name of the host
+func (h *Host) Name() string {
+	return h.name
+}
+
+// commandName generates a host name from the path, arguments and working
+// directory of a command
+func commandName(c *exec.Cmd) string {
+	f := fnv.New32a()
+	io.WriteString(f, c.Path)
+	for _, arg := range c.Args {
+		f.Write([]byte{0})
+		io.WriteString(f, arg)
+	}
+	f.Write([]byte{0})
+	io.WriteString(f, c.Dir)
+	return "host-" + strconv.FormatUint(uint64(f.Sum32()), 16)
+}
+
+func (h *Host) setupCmd(c *exec.Cmd) (*process, error) {
 	select {
 	case <-h.proxy.closed:
-		return nil, nil, ErrProxyClosed
+		return nil, ErrProxyClosed
 	default:
 	}
 	var (
@@ -52,12 +163,12 @@ func (h *Host) setupCmd(c *exec.Cmd) (*transfer, *transfer, error) {
 			}
 		}
 	}()
-	if h.proxy.http != nil {
+	if h.proxy.http != nil || h.proxy.https != nil {
 		c.Env = append(c.Env, "proxyHTTPSocket="+strconv.FormatUint(uint64(len(c.ExtraFiles))+3, 10))
 		var err error
 		http, err = newTransfer()
 		if err != nil {
-			return nil, nil, err
+			return nil, err
 		}
 		c.ExtraFiles = append(c.ExtraFiles, http.f)
 	}
@@ -66,21 +177,257 @@ func (h *Host) setupCmd(c *exec.Cmd) (*transfer, *transfer, error) {
 		var err error
 		https, err = newTransfer()
 		if err != nil {
-			return nil, nil, err
+			return nil, err
 		}
 		c.ExtraFiles = append(c.ExtraFiles, https.f)
 	}
-	if err := c.Start(); err != nil {
-		return nil, nil, err
+	if err := h.startCmd(c); err != nil {
+		return nil, err
 	}
 	done = true
-	return http, https, nil
+	noReadiness := h.noReadiness.Load()
+	for _, t := range [...]*transfer{http, https} {
+		if t == nil {
+			continue
+		}
+		t.started()
+		if noReadiness {
+			t.markReady()
+		}
+	}
+	pr := &process{
+		name:          h.name,
+		cmd:           c,
+		httpTransfer:  http,
+		httpsTransfer: https,
+		started:       time.Now(),
+		done:          make(chan struct{}),
+	}
+	h.proxy.track(pr)
+	go h.watch(pr)
+	return pr, nil
+}
+
+// setProcesses sets the current instances, failing if any of the processes has
+// already exited.
+//
+// Must be called with the lock held.
+func (h *Host) setProcesses(prs []*process) error {
+	if h.removed {
+		return ErrRemoved
+	}
+	for _, pr := range prs {
+		if pr.exited() {
+			return ErrExited
+		}
+	}
+	h.procs = prs
+	h.stopped = false
+	h.idle = false
+	h.closeIdleLocked()
+	h.updateHealthLocked(nil)
+	for _, pr := range prs {
+		go h.awaitReady(pr)
+	}
+	return nil
+}
+
+// setInstance replaces the process of a single instance, failing if the new
+// process has already exited.
+//
+// Must be called with the lock held.
+func (h *Host) setInstance(n int, pr *process) error {
+	if h.removed {
+		return ErrRemoved
+	}
+	if pr.exited() {
+		return ErrExited
+	}
+	h.procs[n] = pr
+	h.closeIdleLocked()
+	h.updateHealthLocked(nil)
+	go h.awaitReady(pr)
+	return nil
+}
+
+// awaitReady takes the instance out of rotation if the process does not report
+// that it is ready within the start timeout, returning it if it later does
+func (h *Host) awaitReady(pr *process) {
+	for {
+		h.mu.RLock()
+		deadline := pr.started.Add(h.startTimeout)
+		h.mu.RUnlock()
+		timeout := time.Until(deadline)
+		if timeout <= 0 {
+			break
+		}
+		if err := pr.waitReady(timeout); err != ErrStartTimeout {
+			return
+		}
+		// loop to check whether the start timeout has been changed
+	}
+	h.setInstanceHealthy(pr, false, ErrStartTimeout)
+	if pr.waitReady(maxDuration) == nil {
+		h.setInstanceHealthy(pr, true, nil)
+	}
+}
+
+// waitReady holds a connection until the process is ready to receive it, or
+// until the start timeout expires
+func (h *Host) waitReady(pr *process, t *transfer) error {
+	select {
+	case <-t.ready:
+		return nil
+	default:
+	}
+	h.mu.RLock()
+	timeout := time.Until(pr.started.Add(h.startTimeout))
+	h.mu.RUnlock()
+	if timeout <= 0 {
+		return ErrStartTimeout
+	}
+	tm := time.NewTimer(timeout)
+	defer tm.Stop()
+	select {
+	case <-t.ready:
+		return nil
+	case <-pr.done:
+		return ErrExited
+	case <-tm.C:
+		return ErrStartTimeout
+	}
+}
+
+// watch waits for the process to exit, restarting it according to the restart
+// policy if it is still one of the current instances
+func (h *Host) watch(pr *process) {
+	pr.reap()
+	h.proxy.untrack(pr)
+	h.proxy.logf("host %s: process %d exited: %s\n", h.name, pr.pid(), pr.cmd.ProcessState)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.instance(pr) < 0 || h.stopped {
+		return
+	}
+	h.updateHealthLocked(ErrExited)
+	if !h.policy.shouldRestart(pr.err) {
+		return
+	}
+	for {
+		now := time.Now()
+		window := now.Add(-h.policy.window())
+		for len(h.restarts) > 0 && h.restarts[0].Before(window) {
+			h.restarts = h.restarts[1:]
+		}
+		delay, ok := h.policy.backoff(len(h.restarts))
+		if !ok {
+			h.proxy.logf("host %s: restarted too many times, not restarting\n", h.name)
+			return
+		}
+		h.proxy.logf("host %s: restarting in %s\n", h.name, delay)
+		h.mu.Unlock()
+		t := time.NewTimer(delay)
+		select {
+		case <-t.C:
+		case <-h.proxy.closed:
+			t.Stop()
+			h.mu.Lock()
+			return
+		}
+		h.mu.Lock()
+		n := h.instance(pr)
+		if n < 0 || h.stopped {
+			return
+		}
+		h.restarts = append(h.restarts, time.Now())
+		npr, err := h.setupCmd(copyCmd(h.template))
+		if err == nil {
+			if err = h.setInstance(n, npr); err == nil {
+				h.proxy.logf("host %s: restarted as process %d\n", h.name, npr.pid())
+				return
+			}
+			npr.close()
+			npr.cmd.Process.Kill()
+			if err == ErrRemoved {
+				return
+			}
+		} else if err == ErrProxyClosed {
+			return
+		}
+		h.proxy.logf("host %s: error restarting: %s\n", h.name, err)
+	}
+}
+
+// SetTimeouts sets how long a new host process has to report that it is ready,
+// and how long an old process has to finish its connections before it is
+// killed, when a host is restarted or replaced.
+//
+// Connections for a host are held until its process is ready, and the host is
+// marked as failed if it does not become ready within the start timeout. See
+// SetReadiness for commands that do not report when they are ready.
+func (h *Host) SetTimeouts(start, drain time.Duration) {
+	h.mu.Lock()
+	if start > 0 {
+		h.startTimeout = start
+	}
+	if drain > 0 {
+		h.drainTimeout = drain
+	}
+	h.mu.Unlock()
 }
 
-// AddAliases simply adds aliases to the host
+// SetReadiness sets whether the host processes report when they are ready to
+// receive connections, which is the default, as processes using proxy/client
+// do. When they do not, processes are treated as ready as soon as they are
+// started, including any that are currently running.
+//
+// A process that does not report that it is ready when expected to will have
+// its connections held until the start timeout, after which it is taken out
+// of rotation, and Restart and Replace will kill it and fail.
+func (h *Host) SetReadiness(reports bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.noReadiness.Store(!reports)
+	if reports {
+		return
+	}
+	for _, pr := range h.procs {
+		for _, t := range [...]*transfer{pr.httpTransfer, pr.httpsTransfer} {
+			if t != nil {
+				t.markReady()
+			}
+		}
+	}
+}
+
+// SetRestartPolicy sets the policy used to determine whether the host process
+// is restarted when it exits
+func (h *Host) SetRestartPolicy(policy RestartPolicy) {
+	h.mu.Lock()
+	h.policy = policy
+	h.mu.Unlock()
+}
+
+// AddAliases simply adds aliases to the host.
+//
+// In addition to exact hostnames, an alias can be of the form "*.example.com",
+// which will match all subdomains of example.com, or ".example.com", which
+// will also match example.com itself. Exact aliases take precedence over
+// wildcards, and longer wildcards take precedence over shorter ones.
+//
+// Any of these can be followed by a path prefix, such as "example.com/api/",
+// to route HTTP connections whose first request has a path starting with
+// that prefix. Path routes take precedence over the alias without a path,
+// with longer prefixes taking precedence over shorter ones. The whole
+// connection is passed to the host, so later requests on a keep-alive
+// connection are sent to the same host regardless of their path. HTTPS
+// connections are routed by hostname only.
 func (h *Host) AddAliases(names ...string) error {
 	h.mu.Lock()
 	defer h.mu.Unlock()
+	if h.removed {
+		return ErrRemoved
+	}
 NameLoop:
 	for _, name := range names {
 		for _, alias := range h.aliases {
@@ -88,6 +435,9 @@ NameLoop:
 				continue NameLoop
 			}
 		}
+		if !ValidAlias(name) {
+			return ErrInvalidAlias{name}
+		}
 		if h.proxy.addAlias(h, name) {
 			h.aliases = append(h.aliases, name)
 		} else {
@@ -107,6 +457,7 @@ NameLoop:
 			if alias == name {
 				h.proxy.removeAlias(name)
 				copy(h.aliases[n:], h.aliases[n+1:])
+				h.aliases = h.aliases[:len(h.aliases)-1]
 				continue NameLoop
 			}
 		}
@@ -124,24 +475,24 @@ func (h *Host) Aliases() []string {
 	return s
 }
 
-// Restart will restart the host
+// Restart will restart the host.
+//
+// The current instances continue to receive connections until the new ones
+// report that they are ready, after which the old processes are drained.
 func (h *Host) Restart() error {
-	h.mu.Lock()
-	defer h.mu.Unlock()
-	cmd := exec.Command(h.cmd.Path, h.cmd.Args...)
-	http, https, err := h.setupCmd(cmd)
-	if err != nil {
-		return err
-	}
-	h.httpTransfer.Close()
-	h.httpsTransfer.Close()
-	h.cmd = cmd
-	h.httpTransfer = http
-	h.httpsTransfer = https
-	return nil
+	h.mu.RLock()
+	c := copyCmd(h.template)
+	h.mu.RUnlock()
+	return h.handover(c, nil)
 }
 
-// Stop will stop the host
+// Stop will stop the host, removing its aliases and stopping any health
+// checks and idle timeout.
+//
+// The host processes are signalled to exit, and are killed if they have not
+// done so within the drain timeout. Stop returns once the processes have been
+// reaped, so it blocks for up to the drain timeout. The host can be started
+// again with Restart or Replace.
 func (h *Host) Stop() error {
 	if h.proxy.IsDefault(h) {
 		select {
@@ -151,57 +502,282 @@ func (h *Host) Stop() error {
 		}
 	}
 	h.mu.Lock()
-	defer h.mu.Unlock()
-	var err error
-	if h.httpTransfer != nil {
-		err = h.httpTransfer.Close()
-		h.httpTransfer = nil
-	}
-	if h.httpsTransfer != nil {
-		if e := h.httpsTransfer.Close(); e != nil {
-			err = e
-		}
-		h.httpsTransfer = nil
-	}
+	prs := append([]*process(nil), h.procs...)
+	h.stopped = true
+	h.idle = false
 	for _, alias := range h.aliases {
 		h.proxy.removeAlias(alias)
 	}
 	h.aliases = h.aliases[:0]
-	return err
+	if h.healthStop != nil {
+		close(h.healthStop)
+		h.healthStop = nil
+	}
+	if h.idleStop != nil {
+		close(h.idleStop)
+		h.idleStop = nil
+	}
+	h.closeIdleLocked()
+	drainTimeout := h.drainTimeout
+	h.mu.Unlock()
+	var wg sync.WaitGroup
+	for _, pr := range prs {
+		wg.Add(1)
+		go func(pr *process) {
+			pr.stop(drainTimeout)
+			wg.Done()
+		}(pr)
+	}
+	wg.Wait()
+	return nil
+}
+
+// Drain stops the host receiving connections and asks its processes to finish
+// their current connections and exit, killing them after the drain timeout.
+//
+// Unlike Stop, the aliases of the host are kept, with connections being sent to
+// any fallback while the host is drained. The host can be started again with
+// Restart or Replace.
+func (h *Host) Drain() error {
+	h.mu.Lock()
+	prs := h.procs
+	if len(prs) == 0 || h.stopped {
+		h.mu.Unlock()
+		return ErrNotRunning
+	}
+	h.stopped = true
+	h.closeIdleLocked()
+	drainTimeout := h.drainTimeout
+	h.mu.Unlock()
+	for _, pr := range prs {
+		go pr.drain(drainTimeout)
+	}
+	return nil
 }
 
 // Replace stops the current host executeable and starts the given command in
-// its place
+// its place.
+//
+// The current instances continue to receive connections until the new ones
+// report that they are ready, after which the old processes are drained.
 func (h *Host) Replace(c *exec.Cmd) error {
-	http, https, err := h.setupCmd(c)
-	if err != nil {
-		return err
+	return h.handover(c, copyCmd(c))
+}
+
+// handover starts the given command, along with copies of the template for any
+// further instances, waits for them to be ready, and then makes them the
+// current instances, draining the old ones.
+//
+// An idle host only has its template replaced, to be used when it is next
+// started.
+func (h *Host) handover(c, template *exec.Cmd) error {
+	h.mu.Lock()
+	if h.idle {
+		if template != nil {
+			h.template = template
+		}
+		h.mu.Unlock()
+		return nil
+	}
+	instances, startTimeout := h.instances, h.startTimeout
+	src := template
+	if src == nil {
+		src = h.template
+	}
+	h.mu.Unlock()
+	prs := make([]*process, 0, instances)
+	kill := func() {
+		for _, pr := range prs {
+			pr.close()
+			pr.cmd.Process.Kill()
+		}
+	}
+	for n := 0; n < instances; n++ {
+		if n > 0 {
+			c = copyCmd(src)
+		}
+		pr, err := h.setupCmd(c)
+		if err != nil {
+			kill()
+			return err
+		}
+		prs = append(prs, pr)
+	}
+	deadline := time.Now().Add(startTimeout)
+	for _, pr := range prs {
+		if err := pr.waitReady(time.Until(deadline)); err != nil {
+			kill()
+			return err
+		}
 	}
 	h.mu.Lock()
-	h.httpTransfer.Close()
-	h.httpsTransfer.Close()
-	h.cmd = c
-	h.httpTransfer = http
-	h.httpsTransfer = https
+	old := h.procs
+	if err := h.setProcesses(prs); err != nil {
+		h.mu.Unlock()
+		kill()
+		return err
+	}
+	if template != nil {
+		h.template = template
+	}
+	drainTimeout := h.drainTimeout
 	h.mu.Unlock()
+	for _, pr := range old {
+		go pr.drain(drainTimeout)
+	}
 	return nil
 }
 
-func (h *Host) getTransfer(encrypted bool) *transfer {
+// Status contains information about the current state of a host
+type Status struct {
+	// PID is the process ID of the first instance of the host, or zero if
+	// there is none
+	PID int
+	// Running is whether the first instance is running, and Ready is
+	// whether it has reported that it is ready to receive connections
+	Running, Ready bool
+	// Started is when the first instance was started
+	Started time.Time
+	// Healthy is whether the host is currently receiving connections
+	Healthy bool
+	// Idle is whether the host is waiting for a connection to start its
+	// processes
+	Idle bool
+	// Restarts is the number of automatic restarts, across all instances,
+	// within the restart window
+	Restarts int
+	// Instances contains the state of each instance of the host
+	Instances []InstanceStatus
+	// Usage contains the resources being used by the host
+	Usage Usage
+}
+
+// InstanceStatus contains information about the current state of a single
+// instance of a host
+type InstanceStatus struct {
+	// PID is the process ID of the instance
+	PID int
+	// Running is whether the instance is running, and Ready is whether it
+	// has reported that it is ready to receive connections
+	Running, Ready bool
+	// Started is when the instance was started
+	Started time.Time
+	// Healthy is whether the instance is in rotation
+	Healthy bool
+	// Connections is the number of connections passed to the instance that
+	// it has not reported as closed
+	Connections int64
+}
+
+// Status returns the current state of the host
+func (h *Host) Status() Status {
 	h.mu.RLock()
-	defer h.mu.RUnlock()
-	if encrypted {
-		return h.httpsTransfer
+	s := Status{
+		Healthy:  !h.unhealthy,
+		Idle:     h.idle,
+		Restarts: len(h.restarts),
 	}
-	return h.httpTransfer
+	if h.stopped {
+		h.mu.RUnlock()
+		return s
+	}
+	prs := append([]*process(nil), h.procs...)
+	for _, pr := range prs {
+		s.Instances = append(s.Instances, InstanceStatus{
+			PID:         pr.pid(),
+			Running:     !pr.exited(),
+			Ready:       pr.ready(),
+			Started:     pr.started,
+			Healthy:     !pr.unhealthy && !pr.exited(),
+			Connections: pr.connections(),
+		})
+	}
+	if len(s.Instances) > 0 {
+		first := s.Instances[0]
+		s.PID, s.Running, s.Ready, s.Started = first.PID, first.Running, first.Ready, first.Started
+	}
+	h.mu.RUnlock()
+	s.Usage = h.usage(prs)
+	return s
+}
+
+// Signal sends a signal to the current host processes
+func (h *Host) Signal(sig os.Signal) error {
+	prs := h.processes()
+	if len(prs) == 0 {
+		return ErrNotRunning
+	}
+	var err error
+	for _, pr := range prs {
+		if e := pr.cmd.Process.Signal(sig); e != nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Wait waits for the current host processes to exit
+func (h *Host) Wait() {
+	for _, pr := range h.processes() {
+		<-pr.done
+	}
+}
+
+// TerminateTLS sets the TLS configuration that the proxy will use to terminate
+// HTTPS connections for this host, passing the decrypted stream to the host
+// over its HTTP socket. A nil config returns to passing the encrypted
+// connection through to the host.
+//
+// Only HTTP/1.1 is offered to clients unless NextProtos is set in the config.
+// When the HTTPS listener is in ModeReverseProxy, where the proxy serves the
+// requests itself, HTTP/2 is offered as well.
+func (h *Host) TerminateTLS(config *tls.Config) {
+	var reverse *tls.Config
+	if config != nil {
+		if len(config.NextProtos) == 0 {
+			config = config.Clone()
+			config.NextProtos = []string{"http/1.1"}
+		}
+		reverse = reverseTLSConfig(config)
+	}
+	h.mu.Lock()
+	h.tlsConfig = config
+	h.reverseTLSConfig = reverse
+	h.mu.Unlock()
+}
+
+func (h *Host) getTLSConfig() *tls.Config {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.tlsConfig
+}
+
+func (h *Host) getReverseTLSConfig() *tls.Config {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.reverseTLSConfig
 }
 
 // Errors
 var (
-	ErrIsDefault   = errors.New("host is default")
-	ErrProxyClosed = errors.New("proxy closed")
+	ErrIsDefault    = errors.New("host is default")
+	ErrProxyClosed  = errors.New("proxy closed")
+	ErrExited       = errors.New("host process exited")
+	ErrStartTimeout = errors.New("timeout waiting for host process to be ready")
+	ErrRemoved      = errors.New("host removed")
+	ErrInvalidName  = errors.New("invalid host name")
 )
 
+// ErrHostExists is an error returned when trying to create a host with the
+// same name as an existing host
+type ErrHostExists struct {
+	Name string
+}
+
+func (e ErrHostExists) Error() string {
+	return "host already exists: " + e.Name
+}
+
 // ErrAliasInUse is an error returned when trying to give a host an alias
 // already in use by another host
 type ErrAliasInUse struct {
@@ -212,6 +788,16 @@ func (e ErrAliasInUse) Error() string {
 	return "server alias already in use: " + e.Name
 }
 
+// ErrInvalidAlias is an error returned when trying to add an alias that is
+// neither a hostname nor a valid wildcard
+type ErrInvalidAlias struct {
+	Name string
+}
+
+func (e ErrInvalidAlias) Error() string {
+	return "invalid server alias: " + e.Name
+}
+
 // ErrUnknownAlias is an error returned when trying to remove an alias from a
 // host where it is not set
 type ErrUnknownAlias struct {
@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"os/exec"
+	"testing"
+	"time"
+)
+
+func TestReadiness(t *testing.T) {
+	p := newTestProxy(t)
+	for n, test := range [...]struct {
+		Reports bool
+		Err     error
+	}{
+		{true, ErrStartTimeout},
+		{false, nil},
+	} {
+		h, err := p.NewNamedHost("host", exec.Command("sleep", "10"))
+		if err != nil {
+			t.Fatalf("test %d: unexpected error creating host: %s", n+1, err)
+		}
+		h.SetTimeouts(100*time.Millisecond, 100*time.Millisecond)
+		h.SetReadiness(test.Reports)
+		if ready := h.Status().Ready; ready == test.Reports {
+			t.Errorf("test %d: expecting ready %v, got %v", n+1, !test.Reports, ready)
+		}
+		if err = h.Restart(); err != test.Err {
+			t.Errorf("test %d: expecting error %v, got %v", n+1, test.Err, err)
+		}
+		if err = p.RemoveHost(h); err != nil {
+			t.Errorf("test %d: unexpected error removing host: %s", n+1, err)
+		}
+	}
+}
+
+func TestNewHostName(t *testing.T) {
+	p := newTestProxy(t)
+	var names []string
+	for _, args := range [...][]string{
+		{"10"},
+		{"10"},
+		{"20"},
+	} {
+		h, err := p.NewHost(exec.Command("sleep", args...))
+		if err != nil {
+			t.Fatalf("unexpected error creating host: %s", err)
+		}
+		names = append(names, h.Name())
+		defer p.RemoveHost(h)
+	}
+	if names[0] == names[2] {
+		t.Errorf("expecting different names for different commands, got %q", names[0])
+	}
+	if names[1] != names[0]+"-2" {
+		t.Errorf("expecting duplicate command to be named %q, got %q", names[0]+"-2", names[1])
+	}
+	if name := commandName(exec.Command("sleep", "10")); name != names[0] {
+		t.Errorf("expecting generated name to be stable, got %q and %q", names[0], name)
+	}
+	if _, err := p.NewNamedHost("", exec.Command("sleep", "10")); err != ErrInvalidName {
+		t.Errorf("expecting ErrInvalidName, got %v", err)
+	}
+}
@@ -0,0 +1,141 @@
+package proxy
+
+import (
+	"os/exec"
+	"time"
+)
+
+// NewOnDemandHost creates a new Host from the given command, as NewNamedHost,
+// but does not run the command until the host receives its first connection,
+// which is held until the host is ready to receive it.
+func (p *Proxy) NewOnDemandHost(name string, c *exec.Cmd) (*Host, error) {
+	if name == "" {
+		return nil, ErrInvalidName
+	}
+	return p.newHost(name, c, true)
+}
+
+// SetOnDemand changes whether the host is run on demand, as with
+// NewOnDemandHost.
+//
+// Turning it off starts the processes of an idle host, and turning it on
+// drains a running host with no open connections, leaving it to be started by
+// its next connection.
+func (h *Host) SetOnDemand(onDemand bool) error {
+	if !onDemand {
+		return h.wake()
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.stopped && !h.idle && len(h.procs) > 0 && h.connectionsLocked() == 0 {
+		h.sleepLocked()
+	}
+	return nil
+}
+
+// SetIdleTimeout sets how long the host processes are left running while no
+// connections are passed to them, and they report no open connections, before
+// they are drained, with the next connection starting them again. The default
+// of zero leaves the processes running.
+func (h *Host) SetIdleTimeout(timeout time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.idleStop != nil {
+		close(h.idleStop)
+		h.idleStop = nil
+	}
+	if timeout > 0 {
+		h.idleStop = make(chan struct{})
+		go h.checkIdle(timeout, h.idleStop)
+	}
+}
+
+// used records that a connection is being passed to the host
+func (h *Host) used() {
+	h.lastUsed.Store(time.Now().UnixNano())
+}
+
+func (h *Host) checkIdle(timeout time.Duration, stop chan struct{}) {
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-stop:
+			return
+		case <-h.proxy.closed:
+			return
+		}
+		h.mu.Lock()
+		wait := time.Until(time.Unix(0, h.lastUsed.Load()).Add(timeout))
+		if wait <= 0 {
+			if !h.stopped && !h.idle && h.connectionsLocked() == 0 {
+				h.sleepLocked()
+			}
+			wait = timeout
+		}
+		h.mu.Unlock()
+		t.Reset(wait)
+	}
+}
+
+// connectionsLocked returns the number of connections that the instances of
+// the host have not reported as closed.
+//
+// Must be called with the lock held.
+func (h *Host) connectionsLocked() int64 {
+	var n int64
+	for _, pr := range h.procs {
+		if !pr.exited() {
+			n += pr.connections()
+		}
+	}
+	return n
+}
+
+// sleepLocked drains the instances of the host, leaving it to be started by
+// the next connection.
+//
+// Must be called with the lock held.
+func (h *Host) sleepLocked() {
+	prs := h.procs
+	h.procs = nil
+	h.idle = true
+	h.closeIdleLocked()
+	h.setHealthyLocked(true, nil)
+	h.proxy.logf("host %s: idle, stopping\n", h.name)
+	for _, pr := range prs {
+		go pr.drain(h.drainTimeout)
+	}
+}
+
+// wake starts the instances of an idle host, leaving it idle if they cannot
+// all be started
+func (h *Host) wake() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.idle {
+		return nil
+	}
+	h.proxy.logf("host %s: starting on demand\n", h.name)
+	prs := make([]*process, 0, h.instances)
+	var err error
+	for len(prs) < h.instances {
+		var pr *process
+		if pr, err = h.setupCmd(copyCmd(h.template)); err != nil {
+			break
+		}
+		prs = append(prs, pr)
+	}
+	if err == nil {
+		err = h.setProcesses(prs)
+	}
+	if err != nil {
+		h.proxy.logf("host %s: error starting: %s\n", h.name, err)
+		for _, pr := range prs {
+			pr.close()
+			pr.cmd.Process.Kill()
+		}
+	}
+	return err
+}
@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"net/http"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+func TestWakeFailure(t *testing.T) {
+	p := newTestProxy(t)
+	fallback := newTestHost(t, p, "fallback")
+	for n, test := range [...]struct {
+		Fallback *Host
+		Status   int
+	}{
+		{nil, http.StatusBadGateway},
+		{fallback, 0},
+	} {
+		h, err := p.NewOnDemandHost("idle", exec.Command("/nonexistent/command"))
+		if err != nil {
+			t.Fatalf("test %d: unexpected error creating host: %s", n+1, err)
+		}
+		h.health = HealthCheck{Fallback: test.Fallback, Status: http.StatusBadGateway}
+		for i := 0; i < 2; i++ {
+			target, status := h.route()
+			if target != test.Fallback {
+				t.Errorf("test %d.%d: expecting fallback host %v, got %v", n+1, i+1, test.Fallback, target)
+			} else if status != test.Status {
+				t.Errorf("test %d.%d: expecting status %d, got %d", n+1, i+1, test.Status, status)
+			}
+			if !h.Healthy() {
+				t.Errorf("test %d.%d: expecting host to remain healthy", n+1, i+1)
+			}
+			h.mu.RLock()
+			idle := h.idle
+			h.mu.RUnlock()
+			if !idle {
+				t.Errorf("test %d.%d: expecting host to remain idle", n+1, i+1)
+			}
+		}
+		if pr, err := h.getProcess(); pr != nil || err == nil {
+			t.Errorf("test %d: expecting no process and an error, got %v, %v", n+1, pr, err)
+		}
+		p.removeHost(h)
+	}
+}
+
+func TestSetOnDemand(t *testing.T) {
+	p := newTestProxy(t)
+	h, err := p.NewOnDemandHost("ondemand", exec.Command("sleep", "60"))
+	if err != nil {
+		t.Fatalf("unexpected error creating host: %s", err)
+	}
+	h.SetReadiness(false)
+	h.SetTimeouts(time.Second, time.Second)
+	defer h.Stop()
+	for n, test := range [...]struct {
+		OnDemand, Idle bool
+	}{
+		{true, true},
+		{false, false},
+		{false, false},
+		{true, true},
+		{false, false},
+	} {
+		h.mu.RLock()
+		prs := h.procs
+		h.mu.RUnlock()
+		if err := h.SetOnDemand(test.OnDemand); err != nil {
+			t.Fatalf("test %d: unexpected error: %s", n+1, err)
+		}
+		h.mu.RLock()
+		idle, running := h.idle, len(h.procs)
+		h.mu.RUnlock()
+		if idle != test.Idle {
+			t.Errorf("test %d: expecting idle %v, got %v", n+1, test.Idle, idle)
+		} else if idle && running != 0 {
+			t.Errorf("test %d: expecting no running instances, got %d", n+1, running)
+		} else if !idle && running != 1 {
+			t.Errorf("test %d: expecting 1 running instance, got %d", n+1, running)
+		}
+		if test.Idle {
+			for _, pr := range prs {
+				select {
+				case <-pr.done:
+				case <-time.After(2 * time.Second):
+					t.Errorf("test %d: expecting previous instance to be drained", n+1)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,344 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// Limits sets the resources available to the processes of a host, with zero
+// values being unlimited
+type Limits struct {
+	// CPU is the number of CPUs that the processes can use between them,
+	// such as 0.5 for half of a single CPU
+	CPU float64
+	// Memory is the number of bytes of memory the processes can use
+	// between them
+	Memory int64
+	// Pids is the number of processes and threads that can be running
+	Pids int
+	// Files is the number of files each process can have open
+	Files int
+}
+
+// Usage contains the resources being used by the processes of a host
+type Usage struct {
+	// CPU is the processor time used by the processes
+	CPU time.Duration
+	// Memory is the number of bytes of memory in use
+	Memory int64
+	// Pids is the number of processes and threads running
+	Pids int
+	// Files is the number of open files
+	Files int
+}
+
+// cpuPeriod is the period, in microseconds, over which the CPU limit is
+// enforced, and minCPUQuota is the smallest quota accepted by the kernel
+const (
+	cpuPeriod   = 100000
+	minCPUQuota = 1000
+)
+
+// clockTicks is the unit of the CPU times in /proc/[pid]/stat
+const clockTicks = 100
+
+// SetCgroup sets a cgroup v2 directory, delegated to the proxy, under which a
+// cgroup is created for each host, with the host processes being started in
+// it, so that the CPU, Memory and Pids limits of the host apply to all of its
+// processes together. The proxy itself must not be in the directory, as
+// processes cannot be in a cgroup that distributes resources to others.
+//
+// Without a cgroup, the Memory and Pids limits of each host are applied to
+// each of its processes with rlimits, with the Memory limit applying to the
+// data segment and the Pids limit counting all processes of the user of the
+// host, and the CPU limit is not enforced. The Files limit is always applied
+// with rlimits.
+//
+// Must be called before any hosts are created.
+func (p *Proxy) SetCgroup(dir string) error {
+	if p.started {
+		return ErrRunning
+	}
+	p.mu.RLock()
+	hosts := len(p.hosts)
+	p.mu.RUnlock()
+	if hosts > 0 {
+		return ErrHostsCreated
+	}
+	if err := os.WriteFile(filepath.Join(dir, "cgroup.subtree_control"), []byte("+cpu +memory +pids"), 0); err != nil {
+		return err
+	}
+	p.cgroup = dir
+	return nil
+}
+
+// createCgroup creates the cgroup of the host, if the proxy has a cgroup
+func (h *Host) createCgroup() error {
+	if h.proxy.cgroup == "" {
+		return nil
+	}
+	name := strings.ReplaceAll(h.name, "/", "_")
+	if name == "." || name == ".." {
+		name = "_" + name
+	}
+	dir := filepath.Join(h.proxy.cgroup, name)
+	if err := os.Mkdir(dir, 0o755); err != nil && !errors.Is(err, fs.ErrExist) {
+		return err
+	}
+	h.cgroup = dir
+	return nil
+}
+
+// removeCgroup removes the cgroup of the host, which must have no running
+// processes
+func (h *Host) removeCgroup() error {
+	if h.cgroup == "" {
+		return nil
+	}
+	return syscall.Rmdir(h.cgroup)
+}
+
+// SetLimits sets the resources available to the host processes, applying
+// them to the running processes as well as any started later.
+//
+// Rlimits are applied to each process just after it is started, so a process
+// is not limited by them during its first moments, and only a cgroup limits a
+// process from the start.
+//
+// Rlimits set both the soft and hard limits, so that the processes cannot
+// raise them. As only a privileged proxy can raise a hard limit, running
+// processes keep their limit when a limit applied with rlimits is raised or
+// removed, with the new limit applying to processes started later.
+//
+// Without a cgroup, the Pids limit counts the processes of the whole user, and
+// so is refused, with ErrPidsLimit, unless the host runs as a user other than
+// that of the proxy, with the other limits still being applied.
+func (h *Host) SetLimits(l Limits) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.removed {
+		return ErrRemoved
+	}
+	var err error
+	if l.Pids > 0 && h.cgroup == "" && !separateUser(h.template) {
+		l.Pids = 0
+		err = ErrPidsLimit
+	}
+	h.limits.Store(&l)
+	if h.cgroup != "" {
+		cpu, memory, pids := "max", "max", "max"
+		if l.CPU > 0 {
+			quota := int(l.CPU * cpuPeriod)
+			if quota < minCPUQuota {
+				quota = minCPUQuota
+			}
+			cpu = strconv.Itoa(quota) + " " + strconv.Itoa(cpuPeriod)
+		}
+		if l.Memory > 0 {
+			memory = strconv.FormatInt(l.Memory, 10)
+		}
+		if l.Pids > 0 {
+			pids = strconv.Itoa(l.Pids)
+		}
+		for _, f := range [...][2]string{
+			{"cpu.max", cpu},
+			{"memory.max", memory},
+			{"pids.max", pids},
+		} {
+			if e := os.WriteFile(filepath.Join(h.cgroup, f[0]), []byte(f[1]), 0); e != nil {
+				err = e
+			}
+		}
+	}
+	for _, pr := range h.procs {
+		if pr.exited() {
+			continue
+		}
+		if e := h.setRlimits(pr.cmd); e != nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// separateUser returns whether the command runs as a user other than that of
+// the proxy
+func separateUser(c *exec.Cmd) bool {
+	return c != nil && c.SysProcAttr != nil && c.SysProcAttr.Credential != nil && int(c.SysProcAttr.Credential.Uid) != os.Getuid()
+}
+
+// startCmd starts the command, in the cgroup of the host if it has one, and
+// applies the rlimits of the host to it
+func (h *Host) startCmd(c *exec.Cmd) error {
+	if h.cgroup != "" {
+		f, err := os.Open(h.cgroup)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		var attr syscall.SysProcAttr
+		if c.SysProcAttr != nil {
+			attr = *c.SysProcAttr
+		}
+		attr.UseCgroupFD = true
+		attr.CgroupFD = int(f.Fd())
+		c.SysProcAttr = &attr
+	}
+	if err := c.Start(); err != nil {
+		return err
+	}
+	if err := h.setRlimits(c); err != nil {
+		h.proxy.logf("host %s: error setting limits of process %d: %s\n", h.name, c.Process.Pid, err)
+	}
+	return nil
+}
+
+// setRlimits applies the limits of the host that are enforced with rlimits to
+// the process of the command.
+//
+// The Pids limit is only applied to processes running as their own user.
+func (h *Host) setRlimits(c *exec.Cmd) error {
+	l := h.limits.Load()
+	if l == nil {
+		return nil
+	}
+	var err error
+	for _, r := range [...]struct {
+		resource int
+		limit    int64
+		cgroup   bool
+	}{
+		{syscall.RLIMIT_NOFILE, int64(l.Files), false},
+		{syscall.RLIMIT_DATA, l.Memory, true},
+		{rlimitNproc, int64(l.Pids), true},
+	} {
+		if r.limit <= 0 || r.cgroup && h.cgroup != "" || r.resource == rlimitNproc && !separateUser(c) {
+			continue
+		}
+		if e := prlimit(c.Process.Pid, r.resource, uint64(r.limit)); e != nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// rlimitNproc is RLIMIT_NPROC, which is missing from the syscall package
+const rlimitNproc = 6
+
+// prlimit sets the soft and hard limits of the resource for the process,
+// leaving a lower hard limit unchanged when the proxy is not permitted to
+// raise it
+func prlimit(pid, resource int, limit uint64) error {
+	rlimit := syscall.Rlimit{
+		Cur: limit,
+		Max: limit,
+	}
+	if _, _, e := syscall.RawSyscall6(syscall.SYS_PRLIMIT64, uintptr(pid), uintptr(resource), uintptr(unsafe.Pointer(&rlimit)), 0, 0, 0); e != 0 {
+		var old syscall.Rlimit
+		if e == syscall.EPERM && getRlimit(pid, resource, &old) == nil && old.Max < limit {
+			return nil
+		}
+		return e
+	}
+	return nil
+}
+
+func getRlimit(pid, resource int, rlimit *syscall.Rlimit) error {
+	if _, _, e := syscall.RawSyscall6(syscall.SYS_PRLIMIT64, uintptr(pid), uintptr(resource), 0, uintptr(unsafe.Pointer(rlimit)), 0, 0); e != 0 {
+		return e
+	}
+	return nil
+}
+
+// usage returns the resources used by the host, read from its cgroup if it
+// has one, and otherwise from the given processes.
+//
+// As it reads from /proc, it should not be called with the lock held.
+func (h *Host) usage(prs []*process) Usage {
+	var u Usage
+	for _, pr := range prs {
+		if pr.exited() {
+			continue
+		}
+		u.Files += countFiles(pr.pid())
+		if h.cgroup == "" {
+			cpu, memory, threads := processUsage(pr.pid())
+			u.CPU += cpu
+			u.Memory += memory
+			u.Pids += threads
+		}
+	}
+	if h.cgroup != "" {
+		u.CPU = time.Duration(readCgroupValue(h.cgroup, "cpu.stat", "usage_usec")) * time.Microsecond
+		u.Memory = readCgroupValue(h.cgroup, "memory.current", "")
+		u.Pids = int(readCgroupValue(h.cgroup, "pids.current", ""))
+	}
+	return u
+}
+
+// readCgroupValue reads a number from a file of the cgroup, taken from the line
+// starting with the key if it is not empty
+func readCgroupValue(dir, file, key string) int64 {
+	data, err := os.ReadFile(filepath.Join(dir, file))
+	if err != nil {
+		return 0
+	}
+	if key != "" {
+		s := bufio.NewScanner(bytes.NewReader(data))
+		for data = nil; s.Scan(); {
+			if fields := strings.Fields(s.Text()); len(fields) == 2 && fields[0] == key {
+				data = []byte(fields[1])
+				break
+			}
+		}
+	}
+	n, _ := strconv.ParseInt(string(bytes.TrimSpace(data)), 10, 64)
+	return n
+}
+
+// processUsage returns the CPU time, resident memory and number of threads of
+// the process
+func processUsage(pid int) (time.Duration, int64, int) {
+	data, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return 0, 0, 0
+	}
+	// skip the command name, which may contain spaces
+	if p := bytes.LastIndexByte(data, ')'); p >= 0 {
+		data = data[p+1:]
+	}
+	// fields are numbered from the state, which is field 3 in proc(5)
+	fields := strings.Fields(string(data))
+	if len(fields) < 22 {
+		return 0, 0, 0
+	}
+	utime, _ := strconv.ParseInt(fields[11], 10, 64)
+	stime, _ := strconv.ParseInt(fields[12], 10, 64)
+	threads, _ := strconv.Atoi(fields[17])
+	rss, _ := strconv.ParseInt(fields[21], 10, 64)
+	return time.Duration(utime+stime) * time.Second / clockTicks, rss * int64(os.Getpagesize()), threads
+}
+
+func countFiles(pid int) int {
+	entries, err := os.ReadDir("/proc/" + strconv.Itoa(pid) + "/fd")
+	if err != nil {
+		return 0
+	}
+	return len(entries)
+}
+
+// Errors
+var (
+	ErrHostsCreated = errors.New("hosts already created")
+	ErrPidsLimit    = errors.New("pids limit needs a cgroup or a separate user")
+)
@@ -0,0 +1,46 @@
+package proxy
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+	"testing"
+)
+
+func TestPidsLimit(t *testing.T) {
+	p := newTestProxy(t)
+	otherUser := exec.Command("true")
+	otherUser.SysProcAttr = &syscall.SysProcAttr{
+		Credential: &syscall.Credential{Uid: uint32(os.Getuid()) + 1},
+	}
+	sameUser := exec.Command("true")
+	sameUser.SysProcAttr = &syscall.SysProcAttr{
+		Credential: &syscall.Credential{Uid: uint32(os.Getuid())},
+	}
+	for n, test := range [...]struct {
+		Cmd  *exec.Cmd
+		Pids int
+		Err  error
+	}{
+		{exec.Command("true"), 0, nil},
+		{exec.Command("true"), 10, ErrPidsLimit},
+		{sameUser, 10, ErrPidsLimit},
+		{otherUser, 10, nil},
+	} {
+		h := newTestHost(t, p, "host")
+		h.template = test.Cmd
+		if err := h.SetLimits(Limits{Pids: test.Pids, Files: 100}); err != test.Err {
+			t.Errorf("test %d: expecting error %v, got %v", n+1, test.Err, err)
+		}
+		l := h.limits.Load()
+		if test.Err == nil && l.Pids != test.Pids {
+			t.Errorf("test %d: expecting pids limit %d, got %d", n+1, test.Pids, l.Pids)
+		} else if test.Err != nil && l.Pids != 0 {
+			t.Errorf("test %d: expecting pids limit to be dropped, got %d", n+1, l.Pids)
+		}
+		if l.Files != 100 {
+			t.Errorf("test %d: expecting files limit 100, got %d", n+1, l.Files)
+		}
+		p.removeHost(h)
+	}
+}
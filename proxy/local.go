@@ -0,0 +1,153 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"sync"
+
+	"vimagination.zapto.org/webserver/proxy/wire"
+)
+
+const acmeChallengePath = "/.well-known/acme-challenge/"
+
+// ACMEChallenges sets a handler that the proxy will use to respond to ACME
+// HTTP-01 challenges received on the HTTP listener, instead of passing them on
+// to a host.
+//
+// Only challenges for hosts that have TLS terminated by the proxy are
+// intercepted, leaving other hosts free to manage their own certificates.
+//
+// Must be called before the proxy is started.
+func (p *Proxy) ACMEChallenges(h http.Handler) error {
+	if p.started {
+		return ErrRunning
+	}
+	s := &http.Server{
+		Handler: h,
+	}
+	s.SetKeepAlivesEnabled(false)
+	p.challenges = newLocalServer(s)
+	return nil
+}
+
+// localServer is used to handle connections within the proxy
+type localServer struct {
+	l      *connListener
+	server *http.Server
+}
+
+func newLocalServer(server *http.Server) *localServer {
+	s := &localServer{
+		l: &connListener{
+			conns:  make(chan net.Conn),
+			closed: make(chan struct{}),
+		},
+		server: server,
+	}
+	go s.server.Serve(s.l)
+	return s
+}
+
+// serve hands the connection to the server, blocking until the server has
+// finished with it
+func (s *localServer) serve(c net.Conn, buf []byte) {
+	s.serveConn(newLocalConn(c, buf, nil), nil)
+}
+
+// serveConn hands the connection, optionally wrapped, to the server, blocking
+// until the server has finished with it
+func (s *localServer) serveConn(lc *localConn, wrap func(net.Conn) net.Conn) {
+	var c net.Conn = lc
+	if wrap != nil {
+		c = wrap(lc)
+	}
+	select {
+	case s.l.conns <- c:
+		<-lc.done
+	case <-s.l.closed:
+	}
+}
+
+func (s *localServer) Close() error {
+	s.l.Close()
+	return s.server.Close()
+}
+
+// localConn is a connection handled by a localServer, which, when given
+// connection information, reports the addresses from it
+type localConn struct {
+	peekedConn
+	info *wire.ConnInfo
+	once sync.Once
+	done chan struct{}
+}
+
+func newLocalConn(c net.Conn, buf []byte, info *wire.ConnInfo) *localConn {
+	return &localConn{
+		peekedConn: peekedConn{
+			Conn: c,
+			buf:  buf,
+		},
+		info: info,
+		done: make(chan struct{}),
+	}
+}
+
+func (l *localConn) RemoteAddr() net.Addr {
+	if l.info != nil && l.info.RemoteAddr != nil {
+		return l.info.RemoteAddr
+	}
+	return l.Conn.RemoteAddr()
+}
+
+func (l *localConn) LocalAddr() net.Addr {
+	if l.info != nil && l.info.LocalAddr != nil {
+		return l.info.LocalAddr
+	}
+	return l.Conn.LocalAddr()
+}
+
+func (l *localConn) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+	})
+	return nil
+}
+
+// connListener is a net.Listener that accepts connections passed to it by the
+// proxy
+type connListener struct {
+	conns  chan net.Conn
+	once   sync.Once
+	closed chan struct{}
+}
+
+func (c *connListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-c.conns:
+		return conn, nil
+	case <-c.closed:
+		return nil, ErrProxyClosed
+	}
+}
+
+func (c *connListener) Close() error {
+	c.once.Do(func() {
+		close(c.closed)
+	})
+	return nil
+}
+
+func (c *connListener) Addr() net.Addr {
+	return localAddr{}
+}
+
+type localAddr struct{}
+
+func (localAddr) Network() string {
+	return "proxy"
+}
+
+func (localAddr) String() string {
+	return "proxy"
+}
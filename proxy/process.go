@@ -0,0 +1,250 @@
+package proxy
+
+import (
+	"os"
+	"os/exec"
+	"time"
+)
+
+// process is a single running instance of a hosts command, along with the
+// sockets used to pass it connections
+type process struct {
+	cmd                         *exec.Cmd
+	httpTransfer, httpsTransfer *transfer
+	started                     time.Time
+	done                        chan struct{}
+	err                         error
+
+	// name is the name of the host that started the process
+	name string
+
+	// unhealthy takes the process out of the rotation of its host, and is
+	// guarded by the lock of the host
+	unhealthy bool
+}
+
+func (pr *process) pid() int {
+	return pr.cmd.Process.Pid
+}
+
+// connections returns the number of connections passed to the process that it
+// has not reported as closed
+func (pr *process) connections() int64 {
+	var n int64
+	for _, tr := range [...]*transfer{pr.httpTransfer, pr.httpsTransfer} {
+		if tr != nil {
+			n += tr.conns.Load()
+		}
+	}
+	return n
+}
+
+// reap waits for the process to exit, closing its transfer sockets
+func (pr *process) reap() {
+	pr.err = pr.cmd.Wait()
+	pr.close()
+	close(pr.done)
+}
+
+func (pr *process) getTransfer(encrypted bool) *transfer {
+	if encrypted {
+		return pr.httpsTransfer
+	}
+	return pr.httpTransfer
+}
+
+// close closes the transfer sockets of the process
+func (pr *process) close() error {
+	var err error
+	if pr.httpTransfer != nil {
+		err = pr.httpTransfer.Close()
+	}
+	if pr.httpsTransfer != nil {
+		if e := pr.httpsTransfer.Close(); e != nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// waitReady waits until the process has reported that it is ready on all of
+// its transfer sockets
+func (pr *process) waitReady(timeout time.Duration) error {
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	for _, tr := range [...]*transfer{pr.httpTransfer, pr.httpsTransfer} {
+		if tr == nil {
+			continue
+		}
+		select {
+		case <-tr.ready:
+		case <-pr.done:
+			return ErrExited
+		case <-t.C:
+			return ErrStartTimeout
+		}
+	}
+	return nil
+}
+
+// ready returns whether the process has reported that it is ready on all of
+// its transfer sockets
+func (pr *process) ready() bool {
+	for _, tr := range [...]*transfer{pr.httpTransfer, pr.httpsTransfer} {
+		if tr == nil {
+			continue
+		}
+		select {
+		case <-tr.ready:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// drain asks the process to finish its current connections and exit, killing
+// it if it has not done so within the timeout
+func (pr *process) drain(timeout time.Duration) {
+	pr.sendDrain()
+	pr.wait(timeout)
+	pr.close()
+}
+
+// sendDrain asks the process to finish its current connections and exit,
+// sending the Drain message for processes using proxy/client, and an interrupt
+// for those that do not read it
+func (pr *process) sendDrain() {
+	for _, tr := range [...]*transfer{pr.httpTransfer, pr.httpsTransfer} {
+		if tr != nil {
+			tr.Drain()
+		}
+	}
+	if !pr.exited() {
+		pr.cmd.Process.Signal(os.Interrupt)
+	}
+}
+
+// stop closes the transfer sockets of the process and signals it to exit,
+// killing it if it has not done so within the timeout
+func (pr *process) stop(timeout time.Duration) {
+	pr.close()
+	if !pr.exited() {
+		pr.cmd.Process.Signal(os.Interrupt)
+	}
+	pr.wait(timeout)
+}
+
+// wait waits for the process to exit and be reaped, killing it if it has not
+// exited within the timeout
+func (pr *process) wait(timeout time.Duration) {
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case <-pr.done:
+	case <-t.C:
+		pr.cmd.Process.Kill()
+		<-pr.done
+	}
+}
+
+func (pr *process) exited() bool {
+	select {
+	case <-pr.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// copyCmd creates an unstarted copy of a command, so that it can be run again
+func copyCmd(c *exec.Cmd) *exec.Cmd {
+	return &exec.Cmd{
+		Path:        c.Path,
+		Args:        append([]string(nil), c.Args...),
+		Env:         append([]string(nil), c.Env...),
+		Dir:         c.Dir,
+		Stdin:       c.Stdin,
+		Stdout:      c.Stdout,
+		Stderr:      c.Stderr,
+		ExtraFiles:  append([]*os.File(nil), c.ExtraFiles...),
+		SysProcAttr: c.SysProcAttr,
+	}
+}
+
+// Default timeouts for host process handovers
+const (
+	DefaultStartTimeout = 30 * time.Second
+	DefaultDrainTimeout = 30 * time.Second
+)
+
+const maxDuration = time.Duration(1<<63 - 1)
+
+// RestartMode determines when a host process will be restarted after it exits
+type RestartMode uint8
+
+// Restart Modes
+const (
+	RestartNever RestartMode = iota
+	RestartOnFailure
+	RestartAlways
+)
+
+// RestartPolicy determines how a host process is restarted after it exits.
+//
+// The delay before a restart starts at MinBackoff and doubles with each
+// restart within Window, up to MaxBackoff. If MaxRestarts is non-zero, and
+// that many restarts have occurred within Window, the host is left stopped.
+type RestartPolicy struct {
+	Mode                   RestartMode
+	MinBackoff, MaxBackoff time.Duration
+	MaxRestarts            int
+	Window                 time.Duration
+}
+
+// Default restart policy values
+const (
+	DefaultMinBackoff    = time.Second
+	DefaultMaxBackoff    = time.Minute
+	DefaultRestartWindow = 10 * time.Minute
+)
+
+func (r RestartPolicy) shouldRestart(err error) bool {
+	switch r.Mode {
+	case RestartAlways:
+		return true
+	case RestartOnFailure:
+		return err != nil
+	}
+	return false
+}
+
+// backoff returns the delay before the next restart, given the number of
+// restarts within the window, and whether the restart should happen at all
+func (r RestartPolicy) backoff(restarts int) (time.Duration, bool) {
+	if r.MaxRestarts > 0 && restarts >= r.MaxRestarts {
+		return 0, false
+	}
+	minBackoff, maxBackoff := r.MinBackoff, r.MaxBackoff
+	if minBackoff <= 0 {
+		minBackoff = DefaultMinBackoff
+	}
+	if maxBackoff <= 0 {
+		maxBackoff = DefaultMaxBackoff
+	}
+	delay := minBackoff
+	for ; restarts > 0 && delay < maxBackoff; restarts-- {
+		delay <<= 1
+	}
+	if delay > maxBackoff {
+		delay = maxBackoff
+	}
+	return delay, true
+}
+
+func (r RestartPolicy) window() time.Duration {
+	if r.Window <= 0 {
+		return DefaultRestartWindow
+	}
+	return r.Window
+}
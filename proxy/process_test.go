@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"errors"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+func TestRestartPolicyBackoff(t *testing.T) {
+	for n, test := range [...]struct {
+		Policy   RestartPolicy
+		Restarts int
+		Delay    time.Duration
+		Restart  bool
+	}{
+		{RestartPolicy{}, 0, DefaultMinBackoff, true},
+		{RestartPolicy{}, 1, 2 * DefaultMinBackoff, true},
+		{RestartPolicy{}, 5, 32 * DefaultMinBackoff, true},
+		{RestartPolicy{}, 6, DefaultMaxBackoff, true},
+		{RestartPolicy{}, 1000, DefaultMaxBackoff, true},
+		{RestartPolicy{MinBackoff: 100 * time.Millisecond, MaxBackoff: time.Second}, 0, 100 * time.Millisecond, true},
+		{RestartPolicy{MinBackoff: 100 * time.Millisecond, MaxBackoff: time.Second}, 1, 200 * time.Millisecond, true},
+		{RestartPolicy{MinBackoff: 100 * time.Millisecond, MaxBackoff: time.Second}, 3, 800 * time.Millisecond, true},
+		{RestartPolicy{MinBackoff: 100 * time.Millisecond, MaxBackoff: time.Second}, 4, time.Second, true},
+		{RestartPolicy{MinBackoff: 2 * time.Second, MaxBackoff: time.Second}, 0, time.Second, true},
+		{RestartPolicy{MaxRestarts: 3}, 2, 4 * DefaultMinBackoff, true},
+		{RestartPolicy{MaxRestarts: 3}, 3, 0, false},
+		{RestartPolicy{MaxRestarts: 3}, 4, 0, false},
+		{RestartPolicy{MaxRestarts: 1}, 0, DefaultMinBackoff, true},
+		{RestartPolicy{MaxRestarts: 1}, 1, 0, false},
+	} {
+		delay, restart := test.Policy.backoff(test.Restarts)
+		if restart != test.Restart {
+			t.Errorf("test %d: expecting restart %v, got %v", n+1, test.Restart, restart)
+		} else if delay != test.Delay {
+			t.Errorf("test %d: expecting delay %s, got %s", n+1, test.Delay, delay)
+		}
+	}
+}
+
+func TestRestartPolicyShouldRestart(t *testing.T) {
+	failed := errors.New("exit status 1")
+	for n, test := range [...]struct {
+		Mode    RestartMode
+		Err     error
+		Restart bool
+	}{
+		{RestartNever, nil, false},
+		{RestartNever, failed, false},
+		{RestartOnFailure, nil, false},
+		{RestartOnFailure, failed, true},
+		{RestartAlways, nil, true},
+		{RestartAlways, failed, true},
+	} {
+		if restart := (RestartPolicy{Mode: test.Mode}).shouldRestart(test.Err); restart != test.Restart {
+			t.Errorf("test %d: expecting restart %v, got %v", n+1, test.Restart, restart)
+		}
+	}
+}
+
+func TestDrainInterrupts(t *testing.T) {
+	c := exec.Command("sh", "-c", "trap 'exit 0' INT; while :; do sleep 0.05; done")
+	if err := c.Start(); err != nil {
+		t.Fatalf("unexpected error starting process: %s", err)
+	}
+	pr := &process{
+		cmd:     c,
+		started: time.Now(),
+		done:    make(chan struct{}),
+	}
+	go pr.reap()
+	time.Sleep(200 * time.Millisecond) // let the shell set its trap
+	start := time.Now()
+	pr.drain(10 * time.Second)
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("expecting process to exit on interrupt, took %s", d)
+	}
+	if pr.err != nil {
+		t.Errorf("expecting clean exit, got %v", pr.err)
+	}
+}
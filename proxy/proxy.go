@@ -2,23 +2,53 @@ package proxy
 
 import (
 	"errors"
+	"log"
 	"net"
+	"sort"
+	"strings"
 	"sync"
 )
 
 // Proxy repsents a listener that will proxy connections to hosts
 type Proxy struct {
-	http, https net.Listener
+	http, https               net.Listener
+	httpTrusted, httpsTrusted []*net.IPNet
+	httpMode, httpsMode       ListenerMode
+
+	challenges *localServer
+	reverse    *localServer
+	logger     *log.Logger
+	cgroup     string
 
 	started bool
 	closed  chan struct{}
 	err     error
 
+	// active counts the connections being handled by the proxy
+	active sync.WaitGroup
+
 	mu          sync.RWMutex
+	shutdown    bool
+	pause       *pause
+	inherited   map[string][]*inheritedHost
+	processes   map[*process]struct{}
+	hosts       map[string]*Host
 	hostnames   map[string]*Host
+	wildcards   map[string]wildcard
+	routes      map[string][]route
 	defaultHost *Host
 }
 
+type wildcard struct {
+	host *Host
+	base bool
+}
+
+type route struct {
+	prefix string
+	host   *Host
+}
+
 // New creates a new Proxy will optional http and https listeners
 func New(http, https net.Listener) *Proxy {
 	if http == nil && https == nil {
@@ -28,7 +58,11 @@ func New(http, https net.Listener) *Proxy {
 		http:      http,
 		https:     https,
 		closed:    make(chan struct{}),
+		processes: make(map[*process]struct{}),
+		hosts:     make(map[string]*Host),
 		hostnames: make(map[string]*Host),
+		wildcards: make(map[string]wildcard),
+		routes:    make(map[string][]route),
 	}
 }
 
@@ -39,11 +73,25 @@ func (p *Proxy) Default(h *Host) error {
 		return ErrInvalidHost
 	}
 	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.hosts[h.name] != h {
+		return ErrInvalidHost
+	}
 	p.defaultHost = h
-	p.mu.Unlock()
 	return nil
 }
 
+// SetLogger sets a logger to record host process exits and restarts
+func (p *Proxy) SetLogger(l *log.Logger) {
+	p.logger = l
+}
+
+func (p *Proxy) logf(format string, v ...interface{}) {
+	if p.logger != nil {
+		p.logger.Printf(format, v...)
+	}
+}
+
 // IsDefault returns whether the given host is currently the default
 func (p *Proxy) IsDefault(h *Host) bool {
 	p.mu.RLock()
@@ -52,7 +100,7 @@ func (p *Proxy) IsDefault(h *Host) bool {
 }
 
 func (p *Proxy) runConns() error {
-	p.started = true
+	p.stopInherited()
 	ec := make(chan error, 1)
 	http := p.http
 	if http != nil {
@@ -68,19 +116,135 @@ func (p *Proxy) runConns() error {
 			ec <- p.run(https, true)
 		}()
 	}
-	p.err = <-ec
+	err := <-ec
+	p.mu.RLock()
+	shutdown := p.shutdown
+	p.mu.RUnlock()
+	if !shutdown {
+		p.err = err
+	}
 	close(p.closed)
-	go p.closeHosts()
+	if p.challenges != nil {
+		p.challenges.Close()
+	}
+	if !shutdown {
+		if p.reverse != nil {
+			p.reverse.Close()
+		}
+		go p.closeHosts()
+	}
 	return p.err
 }
 
+// closeHosts stops all of the hosts, waiting for their processes to exit
 func (p *Proxy) closeHosts() {
-	for _, host := range p.hostnames {
-		host.Stop()
+	var wg sync.WaitGroup
+	for _, host := range p.Hosts() {
+		wg.Add(1)
+		go func(host *Host) {
+			host.Stop()
+			wg.Done()
+		}(host)
 	}
+	wg.Wait()
+}
+
+// Host returns the host with the given name
+func (p *Proxy) Host(name string) *Host {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.hosts[name]
 }
 
-// Run starts the proxy and waits until it is closed to return any errors
+// Hosts returns all of the hosts of the proxy, sorted by name
+func (p *Proxy) Hosts() []*Host {
+	p.mu.RLock()
+	hosts := make([]*Host, 0, len(p.hosts))
+	for _, h := range p.hosts {
+		hosts = append(hosts, h)
+	}
+	p.mu.RUnlock()
+	sort.Slice(hosts, func(i, j int) bool {
+		return hosts[i].name < hosts[j].name
+	})
+	return hosts
+}
+
+// RemoveHost stops the given host and removes it from the proxy, after which
+// its name can be used for a new host. As with Stop, it blocks for up to the
+// drain timeout of the host.
+//
+// The default host cannot be removed, and any hosts using it as the Fallback
+// of their HealthCheck are left without one.
+func (p *Proxy) RemoveHost(h *Host) error {
+	if h.proxy != p {
+		return ErrInvalidHost
+	}
+	p.mu.Lock()
+	if p.defaultHost == h {
+		p.mu.Unlock()
+		return ErrIsDefault
+	}
+	if p.hosts[h.name] != h {
+		p.mu.Unlock()
+		return ErrInvalidHost
+	}
+	delete(p.hosts, h.name)
+	hosts := make([]*Host, 0, len(p.hosts))
+	for _, other := range p.hosts {
+		hosts = append(hosts, other)
+	}
+	p.mu.Unlock()
+	for _, other := range hosts {
+		other.mu.Lock()
+		if other.health.Fallback == h {
+			other.health.Fallback = nil
+		}
+		other.mu.Unlock()
+	}
+	h.mu.Lock()
+	h.removed = true
+	h.mu.Unlock()
+	if err := h.Stop(); err != nil {
+		return err
+	}
+	return h.removeCgroup()
+}
+
+// track records a running process, so that it can be passed on by Upgrade
+func (p *Proxy) track(pr *process) {
+	p.mu.Lock()
+	p.processes[pr] = struct{}{}
+	p.mu.Unlock()
+}
+
+func (p *Proxy) untrack(pr *process) {
+	p.mu.Lock()
+	delete(p.processes, pr)
+	p.mu.Unlock()
+}
+
+func (p *Proxy) addHost(h *Host) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.hosts[h.name]; ok {
+		return false
+	}
+	p.hosts[h.name] = h
+	return true
+}
+
+func (p *Proxy) removeHost(h *Host) {
+	p.mu.Lock()
+	if p.hosts[h.name] == h {
+		delete(p.hosts, h.name)
+	}
+	p.mu.Unlock()
+}
+
+// Run starts the proxy and waits until it is closed to return any errors.
+//
+// When the proxy is stopped with Shutdown, a nil error is returned.
 func (p *Proxy) Run() error {
 	if p.started {
 		return ErrRunning
@@ -88,6 +252,7 @@ func (p *Proxy) Run() error {
 	if p.defaultHost == nil {
 		return ErrNoDefault
 	}
+	p.started = true
 	return p.runConns()
 }
 
@@ -99,6 +264,7 @@ func (p *Proxy) Start() error {
 	if p.defaultHost == nil {
 		return ErrNoDefault
 	}
+	p.started = true
 	go p.runConns()
 	return nil
 }
@@ -112,9 +278,154 @@ func (p *Proxy) Wait() error {
 	return p.err
 }
 
+// getHost finds the host for the given hostname and request path, returning
+// the matching alias.
+//
+// An exact alias is preferred, followed by the wildcard with the longest
+// matching suffix, before falling back to the default host. For each alias,
+// any path prefix routes are checked first, longest prefix first.
+func (p *Proxy) getHost(hostname, path string) (*Host, string) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	var (
+		h     *Host
+		alias string
+	)
+	if matchAlias(hostname, func(name string) bool {
+		h, alias = p.lookup(name, path)
+		return h != nil
+	}) {
+		return h, alias
+	}
+	return p.defaultHost, ""
+}
+
+// matchAlias calls match with each alias that could match the hostname, in
+// order of precedence, until it returns true, returning whether it did.
+//
+// The exact alias is tried first, followed by the wildcards with the longest
+// matching suffix.
+func matchAlias(hostname string, match func(alias string) bool) bool {
+	if match(hostname) || match("."+hostname) {
+		return true
+	}
+	for pos := strings.IndexByte(hostname, '.'); pos >= 0; {
+		if match("*"+hostname[pos:]) || match(hostname[pos:]) {
+			return true
+		}
+		next := strings.IndexByte(hostname[pos+1:], '.')
+		if next < 0 {
+			break
+		}
+		pos += next + 1
+	}
+	return false
+}
+
+// lookup finds the host for an alias, checking the path prefix routes for the
+// alias before the alias itself.
+//
+// Must be called with the lock held.
+func (p *Proxy) lookup(alias, path string) (*Host, string) {
+	if path != "" {
+		for _, r := range p.routes[alias] {
+			if strings.HasPrefix(path, r.prefix) {
+				return r.host, alias + r.prefix
+			}
+		}
+	}
+	if suffix, base, ok := splitAlias(alias); ok {
+		if w, ok := p.wildcards[suffix]; ok && w.base == base {
+			return w.host, alias
+		}
+	} else if h, ok := p.hostnames[alias]; ok {
+		return h, alias
+	}
+	return nil, ""
+}
+
+// splitAlias determines whether the alias is a wildcard, returning the suffix
+// that it matches.
+//
+// "*.example.com" matches all subdomains of example.com, and ".example.com"
+// matches those as well as example.com itself.
+func splitAlias(name string) (suffix string, base, isWildcard bool) {
+	if strings.HasPrefix(name, "*.") {
+		return name[1:], false, true
+	} else if strings.HasPrefix(name, ".") {
+		return name, true, true
+	}
+	return "", false, false
+}
+
+// splitRoute splits an alias of the form "example.com/prefix/" into its host
+// alias and path prefix
+func splitRoute(name string) (alias, prefix string) {
+	if pos := strings.IndexByte(name, '/'); pos >= 0 {
+		return name[:pos], name[pos:]
+	}
+	return name, ""
+}
+
+// ValidAlias returns whether the given name can be used as a host alias, being
+// either a hostname or a wildcard, with an optional path prefix
+func ValidAlias(name string) bool {
+	name, _ = splitRoute(name)
+	if suffix, _, ok := splitAlias(name); ok {
+		return len(suffix) > 1 && !strings.ContainsRune(suffix, '*')
+	}
+	return name != "" && !strings.ContainsRune(name, '*')
+}
+
+// AliasKey returns the key under which an alias is registered with the proxy.
+//
+// Aliases with the same key cannot be used together, so that "*.example.com"
+// and ".example.com" share a key, as they cover the same subdomains.
+func AliasKey(name string) string {
+	alias, prefix := splitRoute(name)
+	if suffix, _, ok := splitAlias(alias); ok {
+		return suffix + prefix
+	}
+	return name
+}
+
 func (p *Proxy) addAlias(h *Host, name string) bool {
 	p.mu.Lock()
 	defer p.mu.Unlock()
+	if alias, prefix := splitRoute(name); prefix != "" {
+		if suffix, base, ok := splitAlias(alias); ok {
+			// as with wildcards without a path, "*.example.com" and
+			// ".example.com" cover the same subdomains
+			other := suffix
+			if base {
+				other = "*" + suffix
+			}
+			for _, r := range p.routes[other] {
+				if r.prefix == prefix {
+					return false
+				}
+			}
+		}
+		routes := p.routes[alias]
+		for _, r := range routes {
+			if r.prefix == prefix {
+				return false
+			}
+		}
+		routes = append(routes, route{prefix: prefix, host: h})
+		sort.SliceStable(routes, func(i, j int) bool {
+			return len(routes[i].prefix) > len(routes[j].prefix)
+		})
+		p.routes[alias] = routes
+		return true
+	}
+	if suffix, base, ok := splitAlias(name); ok {
+		if _, ok = p.wildcards[suffix]; ok {
+			return false
+		}
+		p.wildcards[suffix] = wildcard{host: h, base: base}
+		return true
+	}
 	_, ok := p.hostnames[name]
 	if ok {
 		return false
@@ -125,8 +436,25 @@ func (p *Proxy) addAlias(h *Host, name string) bool {
 
 func (p *Proxy) removeAlias(name string) {
 	p.mu.Lock()
-	delete(p.hostnames, name)
-	p.mu.Unlock()
+	defer p.mu.Unlock()
+	if alias, prefix := splitRoute(name); prefix != "" {
+		routes := p.routes[alias]
+		for n, r := range routes {
+			if r.prefix == prefix {
+				routes = append(routes[:n:n], routes[n+1:]...)
+				break
+			}
+		}
+		if len(routes) == 0 {
+			delete(p.routes, alias)
+		} else {
+			p.routes[alias] = routes
+		}
+	} else if suffix, _, ok := splitAlias(name); ok {
+		delete(p.wildcards, suffix)
+	} else {
+		delete(p.hostnames, name)
+	}
 }
 
 // Errors
@@ -0,0 +1,282 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"net"
+	"slices"
+	"testing"
+)
+
+func newTestProxy(t *testing.T) *Proxy {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error creating listener: %s", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	return New(l, nil)
+}
+
+func newTestHost(t *testing.T, p *Proxy, name string, aliases ...string) *Host {
+	t.Helper()
+	h := &Host{
+		proxy: p,
+		name:  name,
+	}
+	if !p.addHost(h) {
+		t.Fatalf("host %q already exists", name)
+	}
+	if err := h.AddAliases(aliases...); err != nil {
+		t.Fatalf("unexpected error adding aliases to host %q: %s", name, err)
+	}
+	return h
+}
+
+func TestValidAlias(t *testing.T) {
+	for n, test := range [...]struct {
+		Alias string
+		Valid bool
+	}{
+		{"example.com", true},
+		{"*.example.com", true},
+		{".example.com", true},
+		{"*.com", true},
+		{".com", true},
+		{"", false},
+		{"*", false},
+		{"*.", false},
+		{".", false},
+		{"*example.com", false},
+		{"www.*.example.com", false},
+		{"*.*.example.com", false},
+		{"example.com/api/", true},
+		{"*.example.com/api/", true},
+		{"*/api/", false},
+	} {
+		if valid := ValidAlias(test.Alias); valid != test.Valid {
+			t.Errorf("test %d: alias %q: expecting valid %v, got %v", n+1, test.Alias, test.Valid, valid)
+		}
+	}
+}
+
+func TestAliasKey(t *testing.T) {
+	for n, test := range [...]struct {
+		Alias, Key string
+	}{
+		{"example.com", "example.com"},
+		{"*.example.com", ".example.com"},
+		{".example.com", ".example.com"},
+		{"example.com/api/", "example.com/api/"},
+		{"*.example.com/api/", ".example.com/api/"},
+		{".example.com/api/", ".example.com/api/"},
+	} {
+		if key := AliasKey(test.Alias); key != test.Key {
+			t.Errorf("test %d: alias %q: expecting key %q, got %q", n+1, test.Alias, test.Key, key)
+		}
+	}
+}
+
+func TestGetHost(t *testing.T) {
+	p := newTestProxy(t)
+	def := newTestHost(t, p, "default")
+	p.Default(def)
+	hosts := map[string]*Host{
+		"default":  def,
+		"exact":    newTestHost(t, p, "exact", "www.example.com"),
+		"sub":      newTestHost(t, p, "sub", "*.example.com"),
+		"deep":     newTestHost(t, p, "deep", "*.deep.example.com"),
+		"base":     newTestHost(t, p, "base", ".example.org"),
+		"baseDeep": newTestHost(t, p, "baseDeep", ".a.example.org"),
+	}
+	for n, test := range [...]struct {
+		Hostname, Host, Alias string
+	}{
+		{"www.example.com", "exact", "www.example.com"},
+		{"mail.example.com", "sub", "*.example.com"},
+		{"a.b.example.com", "sub", "*.example.com"},
+		{"example.com", "default", ""},
+		{"x.deep.example.com", "deep", "*.deep.example.com"},
+		{"deep.example.com", "sub", "*.example.com"},
+		{"example.org", "base", ".example.org"},
+		{"www.example.org", "base", ".example.org"},
+		{"a.example.org", "baseDeep", ".a.example.org"},
+		{"b.a.example.org", "baseDeep", ".a.example.org"},
+		{"example.net", "default", ""},
+		{"", "default", ""},
+	} {
+		h, alias := p.getHost(test.Hostname, "")
+		if h != hosts[test.Host] {
+			name := "<nil>"
+			if h != nil {
+				name = h.name
+			}
+			t.Errorf("test %d: hostname %q: expecting host %q, got %q", n+1, test.Hostname, test.Host, name)
+		} else if alias != test.Alias {
+			t.Errorf("test %d: hostname %q: expecting alias %q, got %q", n+1, test.Hostname, test.Alias, alias)
+		}
+	}
+}
+
+func TestAliasInUse(t *testing.T) {
+	p := newTestProxy(t)
+	a := newTestHost(t, p, "a", "example.com", "*.example.com", ".example.org")
+	b := newTestHost(t, p, "b")
+	for n, test := range [...]struct {
+		Alias string
+		InUse bool
+	}{
+		{"example.com", true},
+		{"*.example.com", true},
+		{".example.com", true},
+		{"*.example.org", true},
+		{".example.org", true},
+		{"www.example.com", false},
+		{"example.org", false},
+		{"*.www.example.com", false},
+	} {
+		err := b.AddAliases(test.Alias)
+		if test.InUse {
+			if _, ok := err.(ErrAliasInUse); !ok {
+				t.Errorf("test %d: alias %q: expecting ErrAliasInUse, got %v", n+1, test.Alias, err)
+			}
+		} else if err != nil {
+			t.Errorf("test %d: alias %q: unexpected error: %s", n+1, test.Alias, err)
+		}
+	}
+	if err := a.AddAliases("example.com"); err != nil {
+		t.Errorf("unexpected error re-adding alias to the same host: %s", err)
+	}
+}
+
+func TestRoutes(t *testing.T) {
+	p := newTestProxy(t)
+	def := newTestHost(t, p, "default")
+	p.Default(def)
+	hosts := map[string]*Host{
+		"default": def,
+		"site":    newTestHost(t, p, "site", "example.com"),
+		"api":     newTestHost(t, p, "api", "example.com/api/"),
+		"v2":      newTestHost(t, p, "v2", "example.com/api/v2/"),
+		"static":  newTestHost(t, p, "static", "example.com/static"),
+		"sub":     newTestHost(t, p, "sub", "*.example.com", "*.example.com/api/"),
+		"base":    newTestHost(t, p, "base", ".example.org/app/"),
+	}
+	for n, test := range [...]struct {
+		Hostname, Request, Host, Alias string
+	}{
+		{"example.com", "GET / HTTP/1.1", "site", "example.com"},
+		{"example.com", "GET /api HTTP/1.1", "site", "example.com"},
+		{"example.com", "GET /api/ HTTP/1.1", "api", "example.com/api/"},
+		{"example.com", "GET /api/users HTTP/1.1", "api", "example.com/api/"},
+		{"example.com", "GET /api/v2 HTTP/1.1", "api", "example.com/api/"},
+		{"example.com", "GET /api/v2/ HTTP/1.1", "v2", "example.com/api/v2/"},
+		{"example.com", "GET /api/v2/users?id=1 HTTP/1.1", "v2", "example.com/api/v2/"},
+		{"example.com", "GET /static.css HTTP/1.1", "static", "example.com/static"},
+		{"example.com", "GET /api/../x HTTP/1.1", "site", "example.com"},
+		{"example.com", "GET /x/../api/v2/ HTTP/1.1", "v2", "example.com/api/v2/"},
+		{"example.com", "GET /api/v2/../users HTTP/1.1", "api", "example.com/api/"},
+		{"example.com", "GET //api/./v2//users HTTP/1.1", "v2", "example.com/api/v2/"},
+		{"example.com", "GET /%61pi/v2/ HTTP/1.1", "v2", "example.com/api/v2/"},
+		{"example.com", "GET /api/%2e%2e/x HTTP/1.1", "site", "example.com"},
+		{"example.com", "GET http://example.com/api/v2/x HTTP/1.1", "v2", "example.com/api/v2/"},
+		{"example.com", "GET http://example.com HTTP/1.1", "site", "example.com"},
+		{"example.com", "OPTIONS * HTTP/1.1", "site", "example.com"},
+		{"example.com", "GET /api/", "site", "example.com"},
+		{"www.example.com", "GET /api/x HTTP/1.1", "sub", "*.example.com/api/"},
+		{"www.example.com", "GET /x HTTP/1.1", "sub", "*.example.com"},
+		{"example.org", "GET /app/ HTTP/1.1", "base", ".example.org/app/"},
+		{"www.example.org", "GET /app/x HTTP/1.1", "base", ".example.org/app/"},
+		{"www.example.org", "GET /x HTTP/1.1", "default", ""},
+	} {
+		h, alias := p.getHost(test.Hostname, requestPath([]byte(test.Request+"\r\nHost: "+test.Hostname+"\r\n\r\n")))
+		if h != hosts[test.Host] {
+			name := "<nil>"
+			if h != nil {
+				name = h.name
+			}
+			t.Errorf("test %d: %q %q: expecting host %q, got %q", n+1, test.Hostname, test.Request, test.Host, name)
+		} else if alias != test.Alias {
+			t.Errorf("test %d: %q %q: expecting alias %q, got %q", n+1, test.Hostname, test.Request, test.Alias, alias)
+		}
+	}
+}
+
+func TestRouteInUse(t *testing.T) {
+	p := newTestProxy(t)
+	newTestHost(t, p, "a", "example.com/api/", "*.example.com/api/", ".example.org/api/")
+	b := newTestHost(t, p, "b")
+	for n, test := range [...]struct {
+		Alias string
+		InUse bool
+	}{
+		{"example.com/api/", true},
+		{"*.example.com/api/", true},
+		{".example.com/api/", true},
+		{"*.example.org/api/", true},
+		{".example.org/api/", true},
+		{"example.com/api/v2/", false},
+		{"example.org/api/", false},
+		{".example.com/app/", false},
+	} {
+		err := b.AddAliases(test.Alias)
+		if test.InUse {
+			if _, ok := err.(ErrAliasInUse); !ok {
+				t.Errorf("test %d: alias %q: expecting ErrAliasInUse, got %v", n+1, test.Alias, err)
+			}
+		} else if err != nil {
+			t.Errorf("test %d: alias %q: unexpected error: %s", n+1, test.Alias, err)
+		}
+	}
+}
+
+func TestMatchAlias(t *testing.T) {
+	for n, test := range [...]struct {
+		Hostname string
+		Aliases  []string
+	}{
+		{"example.com", []string{"example.com", ".example.com", "*.com", ".com"}},
+		{"a.b.example.com", []string{"a.b.example.com", ".a.b.example.com", "*.b.example.com", ".b.example.com", "*.example.com", ".example.com", "*.com", ".com"}},
+		{"localhost", []string{"localhost", ".localhost"}},
+	} {
+		var aliases []string
+		if matchAlias(test.Hostname, func(alias string) bool {
+			aliases = append(aliases, alias)
+			return false
+		}) {
+			t.Errorf("test %d: expecting no match", n+1)
+		}
+		if !slices.Equal(aliases, test.Aliases) {
+			t.Errorf("test %d: expecting aliases %q, got %q", n+1, test.Aliases, aliases)
+		}
+	}
+}
+
+func TestCertificatesMatchRouting(t *testing.T) {
+	p := newTestProxy(t)
+	certs := NewCertificates()
+	aliases := []string{"www.example.com", "*.example.com", "*.deep.example.com", ".example.org", ".a.example.org"}
+	for _, alias := range aliases {
+		newTestHost(t, p, alias, alias)
+		certs.Set(alias, &tls.Certificate{OCSPStaple: []byte(alias)})
+	}
+	for n, hostname := range [...]string{
+		"www.example.com",
+		"mail.example.com",
+		"a.b.example.com",
+		"x.deep.example.com",
+		"deep.example.com",
+		"example.org",
+		"b.a.example.org",
+		"example.com",
+		"example.net",
+	} {
+		_, alias := p.getHost(hostname, "")
+		var certAlias string
+		if cert := certs.Get(hostname); cert != nil {
+			certAlias = string(cert.OCSPStaple)
+		}
+		if alias != certAlias {
+			t.Errorf("test %d: hostname %q: routed to alias %q, got certificate for %q", n+1, hostname, alias, certAlias)
+		}
+	}
+}
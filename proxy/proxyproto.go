@@ -0,0 +1,172 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// maxProxyV1Length is the maximum length of a PROXY protocol v1 header,
+// including the CRLF
+const maxProxyV1Length = 107
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// ProxyProtocol sets the networks from which connections on the specified
+// listener will be expected to start with a PROXY protocol (v1 or v2) header.
+//
+// The addresses from the header will be passed to the host in place of those
+// of the connection. Connections from other addresses are handled normally.
+//
+// Must be called before the proxy is started.
+func (p *Proxy) ProxyProtocol(encrypted bool, trusted ...*net.IPNet) error {
+	if p.started {
+		return ErrRunning
+	}
+	if encrypted {
+		p.httpsTrusted = trusted
+	} else {
+		p.httpTrusted = trusted
+	}
+	return nil
+}
+
+func (p *Proxy) trusted(encrypted bool, addr net.Addr) bool {
+	trusted := p.httpTrusted
+	if encrypted {
+		trusted = p.httpsTrusted
+	}
+	if len(trusted) == 0 {
+		return false
+	}
+	ta, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, n := range trusted {
+		if n.Contains(ta.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// readProxyHeader reads a PROXY protocol header from the connection, reading no
+// further than the end of the header.
+//
+// The returned addresses will be nil when the header does not specify the
+// original addresses, such as for health checks from a load balancer.
+func readProxyHeader(c io.Reader) (net.Addr, net.Addr, error) {
+	buf := make([]byte, len(proxyV2Signature), maxProxyV1Length)
+	if _, err := io.ReadFull(c, buf); err != nil {
+		return nil, nil, err
+	}
+	if bytes.Equal(buf, proxyV2Signature) {
+		return readProxyV2(c)
+	}
+	if !bytes.HasPrefix(buf, []byte("PROXY ")) {
+		return nil, nil, ErrInvalidProxyHeader
+	}
+	char := make([]byte, 1)
+	for !bytes.HasSuffix(buf, []byte("\r\n")) {
+		if len(buf) == maxProxyV1Length {
+			return nil, nil, ErrInvalidProxyHeader
+		}
+		if _, err := io.ReadFull(c, char); err == io.EOF {
+			return nil, nil, io.ErrUnexpectedEOF
+		} else if err != nil {
+			return nil, nil, err
+		}
+		buf = append(buf, char[0])
+	}
+	return parseProxyV1(string(buf[6 : len(buf)-2]))
+}
+
+func parseProxyV1(header string) (net.Addr, net.Addr, error) {
+	fields := strings.Split(header, " ")
+	switch fields[0] {
+	case "UNKNOWN":
+		return nil, nil, nil
+	case "TCP4", "TCP6":
+		if len(fields) != 5 {
+			return nil, nil, ErrInvalidProxyHeader
+		}
+	default:
+		return nil, nil, ErrInvalidProxyHeader
+	}
+	remote, err := parseProxyV1Addr(fields[1], fields[3])
+	if err != nil {
+		return nil, nil, err
+	}
+	local, err := parseProxyV1Addr(fields[2], fields[4])
+	if err != nil {
+		return nil, nil, err
+	}
+	return remote, local, nil
+}
+
+func parseProxyV1Addr(ip, port string) (*net.TCPAddr, error) {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return nil, ErrInvalidProxyHeader
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, ErrInvalidProxyHeader
+	}
+	return &net.TCPAddr{IP: addr, Port: int(p)}, nil
+}
+
+func readProxyV2(c io.Reader) (net.Addr, net.Addr, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(c, header); err != nil {
+		return nil, nil, err
+	}
+	if header[0]>>4 != 2 {
+		return nil, nil, ErrInvalidProxyHeader
+	}
+	buf := make([]byte, binary.BigEndian.Uint16(header[2:]))
+	if _, err := io.ReadFull(c, buf); err != nil {
+		return nil, nil, err
+	}
+	switch header[0] & 0xf {
+	case 0: // LOCAL
+		return nil, nil, nil
+	case 1: // PROXY
+	default:
+		return nil, nil, ErrInvalidProxyHeader
+	}
+	if header[1]&0xf != 1 { // not STREAM
+		return nil, nil, nil
+	}
+	var ipLength int
+	switch header[1] >> 4 {
+	case 1: // AF_INET
+		ipLength = net.IPv4len
+	case 2: // AF_INET6
+		ipLength = net.IPv6len
+	default:
+		return nil, nil, nil
+	}
+	if len(buf) < 2*ipLength+4 {
+		return nil, nil, ErrInvalidProxyHeader
+	}
+	remote := &net.TCPAddr{
+		IP:   net.IP(buf[:ipLength]),
+		Port: int(binary.BigEndian.Uint16(buf[2*ipLength:])),
+	}
+	local := &net.TCPAddr{
+		IP:   net.IP(buf[ipLength : 2*ipLength]),
+		Port: int(binary.BigEndian.Uint16(buf[2*ipLength+2:])),
+	}
+	return remote, local, nil
+}
+
+// Errors
+var (
+	ErrInvalidProxyHeader = errors.New("invalid PROXY protocol header")
+)
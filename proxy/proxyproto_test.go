@@ -0,0 +1,158 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+)
+
+func proxyV2(command, family byte, addrs []byte, extra int) []byte {
+	b := append([]byte{}, proxyV2Signature...)
+	b = append(b, 0x20|command, family, 0, 0)
+	binary.BigEndian.PutUint16(b[len(b)-2:], uint16(len(addrs)+extra))
+	b = append(b, addrs...)
+	return append(b, make([]byte, extra)...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	v4 := []byte{192, 0, 2, 1, 198, 51, 100, 2, 0xd4, 0x31, 0, 80}
+	v6 := make([]byte, 36)
+	copy(v6, net.ParseIP("2001:db8::1"))
+	copy(v6[16:], net.ParseIP("2001:db8::2"))
+	copy(v6[32:], []byte{0x01, 0xbb, 0x01, 0xbb})
+	for n, test := range [...]struct {
+		Header        []byte
+		Remote, Local string
+		Err           error
+	}{
+		{ // 1
+			Header: []byte("PROXY TCP4 192.0.2.1 198.51.100.2 54321 80\r\n"),
+			Remote: "192.0.2.1:54321",
+			Local:  "198.51.100.2:80",
+		},
+		{ // 2
+			Header: []byte("PROXY TCP6 2001:db8::1 2001:db8::2 443 443\r\n"),
+			Remote: "[2001:db8::1]:443",
+			Local:  "[2001:db8::2]:443",
+		},
+		{ // 3
+			Header: []byte("PROXY UNKNOWN\r\n"),
+		},
+		{ // 4
+			Header: []byte("PROXY UNKNOWN ffff::1 ffff::2 1 2\r\n"),
+		},
+		{ // 5
+			Header: []byte("PROXY TCP4 192.0.2.1 198.51.100.2 54321\r\n"),
+			Err:    ErrInvalidProxyHeader,
+		},
+		{ // 6
+			Header: []byte("PROXY UDP4 192.0.2.1 198.51.100.2 54321 80\r\n"),
+			Err:    ErrInvalidProxyHeader,
+		},
+		{ // 7
+			Header: []byte("PROXY TCP4 192.0.2.300 198.51.100.2 54321 80\r\n"),
+			Err:    ErrInvalidProxyHeader,
+		},
+		{ // 8
+			Header: []byte("PROXY TCP4 192.0.2.1 198.51.100.2 65536 80\r\n"),
+			Err:    ErrInvalidProxyHeader,
+		},
+		{ // 9
+			Header: []byte("GET / HTTP/1.1\r\n"),
+			Err:    ErrInvalidProxyHeader,
+		},
+		{ // 10
+			Header: append([]byte("PROXY TCP4 "), bytes.Repeat([]byte{'1'}, maxProxyV1Length)...),
+			Err:    ErrInvalidProxyHeader,
+		},
+		{ // 11
+			Header: []byte("PROXY TCP4 192.0.2.1"),
+			Err:    io.ErrUnexpectedEOF,
+		},
+		{ // 12
+			Header: []byte("PROX"),
+			Err:    io.ErrUnexpectedEOF,
+		},
+		{ // 13
+			Header: proxyV2(1, 0x11, v4, 0),
+			Remote: "192.0.2.1:54321",
+			Local:  "198.51.100.2:80",
+		},
+		{ // 14
+			Header: proxyV2(1, 0x21, v6, 0),
+			Remote: "[2001:db8::1]:443",
+			Local:  "[2001:db8::2]:443",
+		},
+		{ // 15
+			Header: proxyV2(1, 0x11, v4, 7),
+			Remote: "192.0.2.1:54321",
+			Local:  "198.51.100.2:80",
+		},
+		{ // 16
+			Header: proxyV2(0, 0x11, v4, 0),
+		},
+		{ // 17
+			Header: proxyV2(0, 0, nil, 0),
+		},
+		{ // 18
+			Header: proxyV2(1, 0, nil, 0),
+		},
+		{ // 19
+			Header: proxyV2(1, 0x31, make([]byte, 216), 0),
+		},
+		{ // 20
+			Header: proxyV2(1, 0x12, v4, 0),
+		},
+		{ // 21
+			Header: proxyV2(2, 0x11, v4, 0),
+			Err:    ErrInvalidProxyHeader,
+		},
+		{ // 22
+			Header: proxyV2(1, 0x11, v4[:8], 0),
+			Err:    ErrInvalidProxyHeader,
+		},
+		{ // 23
+			Header: proxyV2(1, 0x11, v4, 0)[:20],
+			Err:    io.ErrUnexpectedEOF,
+		},
+		{ // 24
+			Header: proxyV2(1, 0x11, v4, 0)[:14],
+			Err:    io.ErrUnexpectedEOF,
+		},
+		{ // 25
+			Header: append(append([]byte{}, proxyV2Signature...), 0x11, 0x11, 0, 0),
+			Err:    ErrInvalidProxyHeader,
+		},
+	} {
+		const rest = "GET / HTTP/1.1\r\n"
+		r := bytes.NewReader(append(append([]byte{}, test.Header...), rest...))
+		if test.Err == io.ErrUnexpectedEOF {
+			r = bytes.NewReader(test.Header)
+		}
+		remote, local, err := readProxyHeader(r)
+		if err != test.Err {
+			t.Errorf("test %d: expecting error %v, got %v", n+1, test.Err, err)
+			continue
+		} else if err != nil {
+			continue
+		}
+		if got := addrString(remote); got != test.Remote {
+			t.Errorf("test %d: expecting remote address %q, got %q", n+1, test.Remote, got)
+		}
+		if got := addrString(local); got != test.Local {
+			t.Errorf("test %d: expecting local address %q, got %q", n+1, test.Local, got)
+		}
+		if left, _ := io.ReadAll(r); string(left) != rest {
+			t.Errorf("test %d: expecting %q to be left unread, got %q", n+1, rest, left)
+		}
+	}
+}
+
+func addrString(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
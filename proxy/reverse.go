@@ -0,0 +1,229 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"slices"
+	"strings"
+	"time"
+
+	"vimagination.zapto.org/webserver/proxy/wire"
+)
+
+// ListenerMode determines how the connections from a listener are passed to
+// hosts
+type ListenerMode uint8
+
+// Listener Modes
+const (
+	// ModeTransfer passes each connection to the host chosen for it, over
+	// the transfer socket of the host process
+	ModeTransfer ListenerMode = iota
+	// ModeReverseProxy has the proxy serve HTTP/1.1 and HTTP/2 on each
+	// connection, forwarding each request to the host chosen for it over a
+	// pool of connections passed to the host process
+	ModeReverseProxy
+)
+
+// reverseIdleTimeout is how long the proxy will keep an idle client connection
+// open in ModeReverseProxy
+const reverseIdleTimeout = 2 * time.Minute
+
+// SetMode sets the mode for the specified listener, the default being
+// ModeTransfer.
+//
+// In ModeReverseProxy, HTTPS connections are only served by the proxy when
+// the host chosen by the TLS server name has TLS terminated by the proxy,
+// otherwise they are passed on as in ModeTransfer. Requests are forwarded with
+// X-Forwarded headers describing the client, as the connections passed to
+// the host are shared between clients.
+//
+// Must be called before the proxy is started.
+func (p *Proxy) SetMode(encrypted bool, mode ListenerMode) error {
+	if p.started {
+		return ErrRunning
+	}
+	if encrypted {
+		p.httpsMode = mode
+	} else {
+		p.httpMode = mode
+	}
+	if mode == ModeReverseProxy && p.reverse == nil {
+		server := &http.Server{
+			Handler:     http.HandlerFunc(p.serveReverse),
+			ConnContext: reverseContext,
+			IdleTimeout: reverseIdleTimeout,
+			Protocols:   new(http.Protocols),
+		}
+		server.Protocols.SetHTTP1(true)
+		server.Protocols.SetHTTP2(true)
+		server.Protocols.SetUnencryptedHTTP2(true)
+		p.reverse = newLocalServer(server)
+	}
+	return nil
+}
+
+func (p *Proxy) mode(encrypted bool) ListenerMode {
+	if encrypted {
+		return p.httpsMode
+	}
+	return p.httpMode
+}
+
+type reverseInfoKey struct{}
+
+func reverseContext(ctx context.Context, c net.Conn) context.Context {
+	if tc, ok := c.(*tls.Conn); ok {
+		c = tc.NetConn()
+	}
+	if lc, ok := c.(*localConn); ok {
+		ctx = context.WithValue(ctx, reverseInfoKey{}, lc.info)
+	}
+	return ctx
+}
+
+// serveReverse serves a connection in ModeReverseProxy, blocking until the
+// connection is finished.
+//
+// When the proxy terminated TLS, requests for a hostname other than the TLS
+// server name are rejected, as the connection was secured for that name.
+func (p *Proxy) serveReverse(w http.ResponseWriter, r *http.Request) {
+	info, _ := r.Context().Value(reverseInfoKey{}).(*wire.ConnInfo)
+	hostname := strings.ToLower(r.Host)
+	if host, _, err := net.SplitHostPort(hostname); err == nil {
+		hostname = host
+	}
+	if info != nil && info.TLS && info.Hostname != "" && hostname != info.Hostname {
+		w.WriteHeader(http.StatusMisdirectedRequest)
+		return
+	}
+	h, _ := p.getHost(hostname, cleanPath(r.URL.Path))
+	target, status := h.route()
+	if target == nil {
+		w.WriteHeader(status)
+		return
+	}
+	target.reverseProxy(info != nil && info.Listener == wire.ListenerHTTPS).ServeHTTP(w, r)
+}
+
+// reverseConn hands a connection to the reverse proxy server, terminating TLS
+// with the given config if it is not nil
+func (p *Proxy) reverseConn(c net.Conn, buf []byte, info *wire.ConnInfo, config *tls.Config) {
+	lc := newLocalConn(c, buf, info)
+	if config == nil {
+		p.reverse.serveConn(lc, nil)
+		return
+	}
+	info.TLS = true
+	p.reverse.serveConn(lc, func(c net.Conn) net.Conn {
+		return tls.Server(c, config)
+	})
+}
+
+// reverseTLSConfig returns the TLS config with the HTTP/2 and HTTP/1.1
+// protocols added to its NextProtos, with HTTP/2 preferred, as the host config
+// only lists the protocols of the host itself
+func reverseTLSConfig(config *tls.Config) *tls.Config {
+	if slices.Contains(config.NextProtos, "h2") && slices.Contains(config.NextProtos, "http/1.1") {
+		return config
+	}
+	config = config.Clone()
+	protos := make([]string, 0, len(config.NextProtos)+2)
+	protos = append(protos, "h2", "http/1.1")
+	for _, proto := range config.NextProtos {
+		if proto != "h2" && proto != "http/1.1" {
+			protos = append(protos, proto)
+		}
+	}
+	config.NextProtos = protos
+	return config
+}
+
+// reverseProxy returns the reverse proxy for the host, creating it if
+// necessary, which forwards requests from the given listener
+func (h *Host) reverseProxy(encrypted bool) *httputil.ReverseProxy {
+	n := 0
+	if encrypted {
+		n = 1
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if rp := h.reverse[n]; rp != nil {
+		return rp
+	}
+	rp := &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.Out.URL.Scheme = "http"
+			r.Out.URL.Host = r.In.Host
+			r.Out.Host = r.In.Host
+			r.SetXForwarded()
+		},
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return h.dial(encrypted)
+			},
+			MaxIdleConnsPerHost: 16,
+			IdleConnTimeout:     reverseIdleTimeout,
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			h.proxy.logf("host %s: error forwarding request: %s\n", h.name, err)
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}
+	h.reverse[n] = rp
+	return rp
+}
+
+// closeIdleLocked closes the idle connections of the reverse proxies of the
+// host, so that a process being replaced is not kept busy by them
+func (h *Host) closeIdleLocked() {
+	for _, rp := range h.reverse {
+		if rp != nil {
+			rp.Transport.(*http.Transport).CloseIdleConnections()
+		}
+	}
+}
+
+// dial creates a connection to an instance of the host, passing it over the
+// HTTP transfer socket as if it had come from the specified listener
+func (h *Host) dial(encrypted bool) (net.Conn, error) {
+	pr, err := h.getProcess()
+	if err != nil {
+		return nil, err
+	} else if pr == nil {
+		h.setHealthy(false, ErrNotRunning)
+		return nil, ErrNotRunning
+	}
+	t := pr.getTransfer(false)
+	if err := h.waitReady(pr, t); err != nil {
+		h.instanceFailed(pr, err)
+		return nil, err
+	}
+	local, remote, err := socketPair()
+	if err != nil {
+		return nil, err
+	}
+	info := &wire.ConnInfo{
+		Listener:   wire.ListenerHTTP,
+		Accepted:   time.Now(),
+		RemoteAddr: local.LocalAddr(),
+		LocalAddr:  local.LocalAddr(),
+	}
+	if encrypted {
+		info.Listener = wire.ListenerHTTPS
+		info.TLS = true
+	}
+	err = t.Transfer(remote, nil, info)
+	remote.Close()
+	if err != nil {
+		local.Close()
+		if isSocketError(err) {
+			h.instanceFailed(pr, err)
+		}
+		return nil, err
+	}
+	return local, nil
+}
@@ -0,0 +1,71 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"vimagination.zapto.org/webserver/proxy/wire"
+)
+
+func TestReverseTLSConfig(t *testing.T) {
+	p := newTestProxy(t)
+	h := newTestHost(t, p, "host")
+	for n, test := range [...]struct {
+		NextProtos, Transfer, Reverse []string
+	}{
+		{nil, []string{"http/1.1"}, []string{"h2", "http/1.1"}},
+		{[]string{"http/1.1"}, []string{"http/1.1"}, []string{"h2", "http/1.1"}},
+		{[]string{"http/1.1", "acme-tls/1"}, []string{"http/1.1", "acme-tls/1"}, []string{"h2", "http/1.1", "acme-tls/1"}},
+		{[]string{"h2", "http/1.1"}, []string{"h2", "http/1.1"}, []string{"h2", "http/1.1"}},
+		{[]string{"http/1.1", "h2"}, []string{"http/1.1", "h2"}, []string{"http/1.1", "h2"}},
+	} {
+		h.TerminateTLS(&tls.Config{NextProtos: test.NextProtos})
+		if protos := h.getTLSConfig().NextProtos; !slices.Equal(protos, test.Transfer) {
+			t.Errorf("test %d: expecting protocols %q, got %q", n+1, test.Transfer, protos)
+		}
+		if protos := h.getReverseTLSConfig().NextProtos; !slices.Equal(protos, test.Reverse) {
+			t.Errorf("test %d: expecting reverse proxy protocols %q, got %q", n+1, test.Reverse, protos)
+		}
+	}
+	h.TerminateTLS(nil)
+	if h.getTLSConfig() != nil || h.getReverseTLSConfig() != nil {
+		t.Error("expecting TLS configs to be cleared")
+	}
+}
+
+func TestReverseMisdirected(t *testing.T) {
+	p := newTestProxy(t)
+	def := newTestHost(t, p, "default")
+	p.Default(def)
+	newTestHost(t, p, "a", "a.example.com")
+	newTestHost(t, p, "b", "b.example.com").SetHealthCheck(HealthCheck{Status: http.StatusTeapot})
+	p.Host("b").setHealthy(false, ErrNotRunning)
+	for n, test := range [...]struct {
+		Host   string
+		Info   *wire.ConnInfo
+		Status int
+	}{
+		{"b.example.com", nil, http.StatusTeapot},
+		{"b.example.com", &wire.ConnInfo{Hostname: "a.example.com"}, http.StatusTeapot},
+		{"b.example.com", &wire.ConnInfo{Hostname: "b.example.com", TLS: true}, http.StatusTeapot},
+		{"B.Example.com:443", &wire.ConnInfo{Hostname: "b.example.com", TLS: true}, http.StatusTeapot},
+		{"b.example.com", &wire.ConnInfo{TLS: true}, http.StatusTeapot},
+		{"b.example.com", &wire.ConnInfo{Hostname: "a.example.com", TLS: true}, http.StatusMisdirectedRequest},
+		{"www.b.example.com", &wire.ConnInfo{Hostname: "b.example.com", TLS: true}, http.StatusMisdirectedRequest},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Host = test.Host
+		if test.Info != nil {
+			r = r.WithContext(context.WithValue(r.Context(), reverseInfoKey{}, test.Info))
+		}
+		w := httptest.NewRecorder()
+		p.serveReverse(w, r)
+		if w.Code != test.Status {
+			t.Errorf("test %d: expecting status %d, got %d", n+1, test.Status, w.Code)
+		}
+	}
+}
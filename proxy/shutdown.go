@@ -0,0 +1,125 @@
+package proxy
+
+import (
+	"context"
+	"sort"
+	"sync"
+)
+
+// HostExit records how a process of a host exited during a shutdown
+type HostExit struct {
+	Name string
+	PID  int
+	// Killed is whether the process was killed after failing to exit
+	// before the shutdown deadline
+	Killed bool
+	// Err is the error returned from waiting for the process, which is nil
+	// if it exited with a zero status
+	Err error
+}
+
+// Clean returns whether the process exited by itself with a zero status
+func (e HostExit) Clean() bool {
+	return !e.Killed && e.Err == nil
+}
+
+// Shutdown gracefully stops the proxy.
+//
+// The listeners are closed, and any requests being forwarded in
+// ModeReverseProxy are finished, after which each host is told to drain, with
+// both a Drain message over its transfer sockets and an interrupt signal, and
+// Shutdown waits for the host processes to exit, along with any processes that
+// were already draining, and for the connections being handled by the proxy
+// itself, such as those for which it terminates TLS. Any process still running
+// when the context is done is killed.
+//
+// The returned list, sorted by host name, records how each process exited,
+// with processes that were already draining when passed on by an Upgrade
+// having no name. The error will be that of the context if any process had to
+// be killed.
+func (p *Proxy) Shutdown(ctx context.Context) ([]HostExit, error) {
+	p.mu.Lock()
+	if p.shutdown {
+		p.mu.Unlock()
+		return nil, ErrNotRunning
+	}
+	p.shutdown = true
+	p.mu.Unlock()
+	if p.http != nil {
+		p.http.Close()
+	}
+	if p.https != nil {
+		p.https.Close()
+	}
+	if p.started {
+		<-p.closed
+	}
+	if p.reverse != nil {
+		p.reverse.l.Close()
+		p.reverse.server.Shutdown(ctx)
+	}
+	var (
+		exits   []HostExit
+		prs     []*process
+		current = make(map[*process]struct{})
+		wg      sync.WaitGroup
+	)
+	for _, h := range p.Hosts() {
+		for _, pr := range h.shutdown() {
+			prs = append(prs, pr)
+			current[pr] = struct{}{}
+		}
+	}
+	p.mu.RLock()
+	for pr := range p.processes {
+		if _, ok := current[pr]; !ok {
+			prs = append(prs, pr)
+		}
+	}
+	p.mu.RUnlock()
+	sort.SliceStable(prs, func(i, j int) bool {
+		return prs[i].name < prs[j].name
+	})
+	exits = make([]HostExit, len(prs))
+	for n, pr := range prs {
+		exits[n] = HostExit{Name: pr.name, PID: pr.pid()}
+		wg.Add(1)
+		go func(e *HostExit, pr *process) {
+			select {
+			case <-pr.done:
+			case <-ctx.Done():
+				if !pr.exited() {
+					pr.cmd.Process.Kill()
+					e.Killed = true
+				}
+				<-pr.done
+			}
+			e.Err = pr.err
+			wg.Done()
+		}(&exits[n], pr)
+	}
+	wait(p.active.Wait, ctx.Done())
+	wg.Wait()
+	for _, e := range exits {
+		if e.Killed {
+			return exits, ctx.Err()
+		}
+	}
+	return exits, nil
+}
+
+// shutdown stops the host, without removing its aliases, and asks its
+// processes to drain, returning the processes
+func (h *Host) shutdown() []*process {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.stopped = true
+	if h.healthStop != nil {
+		close(h.healthStop)
+		h.healthStop = nil
+	}
+	for _, pr := range h.procs {
+		pr.sendDrain()
+	}
+	return append([]*process(nil), h.procs...)
+}
@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"context"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+func shellHost(t *testing.T, p *Proxy, name, trap string) *Host {
+	t.Helper()
+	h, err := p.NewNamedHost(name, exec.Command("sh", "-c", "trap '"+trap+"' INT; while :; do sleep 0.05; done"))
+	if err != nil {
+		t.Fatalf("unexpected error creating host %q: %s", name, err)
+	}
+	h.SetReadiness(false)
+	h.SetTimeouts(time.Second, 10*time.Second)
+	return h
+}
+
+func TestShutdown(t *testing.T) {
+	p := newTestProxy(t)
+	shellHost(t, p, "stubborn", "")
+	shellHost(t, p, "graceful", "exit 0")
+	shellHost(t, p, "failing", "exit 3")
+	retired := shellHost(t, p, "retired", "")
+	time.Sleep(200 * time.Millisecond) // let the shells set their traps
+	if err := retired.Replace(exec.Command("sh", "-c", "trap 'exit 0' INT; while :; do sleep 0.05; done")); err != nil {
+		t.Fatalf("unexpected error replacing host: %s", err)
+	}
+	time.Sleep(200 * time.Millisecond) // let the shells set their traps
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	exits, err := p.Shutdown(ctx)
+	if err != context.DeadlineExceeded {
+		t.Errorf("expecting error %v, got %v", context.DeadlineExceeded, err)
+	}
+	expected := [...]struct {
+		Name          string
+		Killed, Clean bool
+	}{
+		{"failing", false, false},
+		{"graceful", false, true},
+		{"retired", false, true},
+		{"retired", true, false},
+		{"stubborn", true, false},
+	}
+	if len(exits) != len(expected) {
+		t.Fatalf("expecting %d exits, got %d: %v", len(expected), len(exits), exits)
+	}
+	for n, e := range exits {
+		if e.Name != expected[n].Name {
+			t.Errorf("exit %d: expecting name %q, got %q", n+1, expected[n].Name, e.Name)
+		} else if e.Killed != expected[n].Killed {
+			t.Errorf("exit %d (%s): expecting killed %v, got %v", n+1, e.Name, expected[n].Killed, e.Killed)
+		} else if e.Clean() != expected[n].Clean {
+			t.Errorf("exit %d (%s): expecting clean %v, got %v (%v)", n+1, e.Name, expected[n].Clean, e.Clean(), e.Err)
+		}
+	}
+	if _, err = p.Shutdown(context.Background()); err != ErrNotRunning {
+		t.Errorf("expecting ErrNotRunning from second shutdown, got %v", err)
+	}
+}
@@ -1,18 +1,26 @@
 package proxy
 
 import (
-	"encoding/binary"
 	"errors"
 	"net"
 	"os"
 	"sync"
+	"sync/atomic"
 	"syscall"
+
+	"vimagination.zapto.org/webserver/proxy/wire"
 )
 
 type transfer struct {
 	mu sync.Mutex
 	f  *os.File
 	c  *net.UnixConn
+
+	ready     chan struct{}
+	readyOnce sync.Once
+	// conns counts the connections passed to the child that it has not
+	// reported as closed
+	conns atomic.Int64
 }
 
 func newTransfer() (*transfer, error) {
@@ -33,37 +41,151 @@ func newTransfer() (*transfer, error) {
 		return nil, ErrBadSocket
 	}
 	return &transfer{
-		f: f,
-		c: uc,
+		f:     f,
+		c:     uc,
+		ready: make(chan struct{}),
 	}, nil
 
 }
 
+// socketPair creates a pair of connected unix sockets, used to pass
+// connections that the proxy has to keep handling itself
+func socketPair() (*net.UnixConn, *net.UnixConn, error) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	var ucs [2]*net.UnixConn
+	for n, fd := range fds {
+		f := os.NewFile(uintptr(fd), "")
+		c, err := net.FileConn(f)
+		f.Close()
+		if err == nil {
+			uc, ok := c.(*net.UnixConn)
+			if ok {
+				ucs[n] = uc
+				continue
+			}
+			c.Close()
+			err = ErrBadSocket
+		}
+		if n == 0 {
+			syscall.Close(fds[1])
+		} else {
+			ucs[0].Close()
+		}
+		return nil, nil, err
+	}
+	return ucs[0], ucs[1], nil
+}
+
 type file interface {
 	File() (*os.File, error)
 }
 
-func (t *transfer) Transfer(c net.Conn, buf []byte) error {
+// Transfer passes the connection to the child.
+//
+// Errors writing to the socket, which indicate a problem with the child, are
+// returned as a socketError, while other errors, such as running out of file
+// descriptors in the proxy, are returned as is.
+func (t *transfer) Transfer(c net.Conn, buf []byte, info *wire.ConnInfo) error {
 	f, err := c.(file).File()
 	if err != nil {
 		return err
 	}
-	length := make([]byte, 4)
-	binary.LittleEndian.PutUint32(length, uint32(len(buf)))
+	defer f.Close()
 	t.mu.Lock()
 	defer t.mu.Unlock()
-	if _, _, err = t.c.WriteMsgUnix(length, syscall.UnixRights(int(f.Fd())), nil); err != nil {
-		return err
+	// counted before writing, as the child may report the connection as
+	// closed before the write returns
+	t.conns.Add(1)
+	if err = wire.WriteConn(t.c, f, info, buf); err != nil {
+		t.conns.Add(-1)
+		var oe *net.OpError
+		if errors.As(err, &oe) {
+			return socketError{err}
+		}
 	}
-	_, err = t.c.Write(buf)
 	return err
 }
 
+// socketError is an error writing to the transfer socket of a child
+type socketError struct {
+	error
+}
+
+func (s socketError) Unwrap() error {
+	return s.error
+}
+
+// isSocketError returns whether a connection could not be passed to a child
+// because of the child, rather than the proxy, and so whether the child should
+// be taken out of rotation
+func isSocketError(err error) bool {
+	var se socketError
+	return errors.As(err, &se)
+}
+
+// started closes the parents copy of the socket passed to the child, so that
+// writes will fail once the child has exited, and starts listening for
+// messages from the child
+func (t *transfer) started() {
+	t.mu.Lock()
+	t.f.Close()
+	t.f = nil
+	t.mu.Unlock()
+	go t.read()
+}
+
+// read handles messages sent by the child
+func (t *transfer) read() {
+	for {
+		m, err := wire.Read(t.c)
+		if err != nil {
+			return
+		}
+		if m.File != nil {
+			m.File.Close()
+		}
+		switch m.Type {
+		case wire.TypeReady:
+			t.markReady()
+		case wire.TypeClosed:
+			t.conns.Add(-1)
+		}
+	}
+}
+
+// markReady records that the child is ready to receive connections
+func (t *transfer) markReady() {
+	t.readyOnce.Do(func() {
+		close(t.ready)
+	})
+}
+
+func (t *transfer) isReady() bool {
+	select {
+	case <-t.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+// Drain tells the child to stop accepting connections on this socket
+func (t *transfer) Drain() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return wire.WriteControl(t.c, wire.TypeDrain)
+}
+
 func (t *transfer) Close() error {
 	t.mu.Lock()
 	defer t.mu.Unlock()
 	err := t.c.Close()
-	t.f.Close()
+	if t.f != nil {
+		t.f.Close()
+	}
 	return err
 }
 
@@ -0,0 +1,40 @@
+package proxy
+
+import (
+	"testing"
+
+	"vimagination.zapto.org/webserver/proxy/wire"
+)
+
+func TestTransferErrors(t *testing.T) {
+	for n, test := range [...]struct {
+		CloseConn, CloseChild, SocketError bool
+	}{
+		{false, false, false},
+		{true, false, false},
+		{false, true, true},
+	} {
+		tr, err := newTransfer()
+		if err != nil {
+			t.Fatalf("test %d: unexpected error creating transfer: %s", n+1, err)
+		}
+		a, b := tcpPair(t)
+		if test.CloseConn {
+			a.Close()
+		}
+		if test.CloseChild {
+			tr.f.Close()
+		}
+		err = tr.Transfer(a, nil, &wire.ConnInfo{})
+		if test.SocketError != isSocketError(err) {
+			t.Errorf("test %d: expecting socket error %v, got %v", n+1, test.SocketError, err)
+		} else if !test.CloseConn && !test.CloseChild && err != nil {
+			t.Errorf("test %d: unexpected error: %s", n+1, err)
+		} else if test.CloseConn && err == nil {
+			t.Errorf("test %d: expecting error", n+1)
+		}
+		a.Close()
+		b.Close()
+		tr.Close()
+	}
+}
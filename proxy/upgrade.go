@@ -0,0 +1,519 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// upgradeEnv is the environment variable used to pass the state of the proxy
+// to the new copy of the program
+const upgradeEnv = "proxyUpgradeState"
+
+// upgradeState is the state passed to the new copy of the program, with file
+// descriptors of -1 representing missing listeners
+type upgradeState struct {
+	HTTP, HTTPS int
+	Hosts       []*inheritedHost
+	// Draining lists the processes that are no longer the current process
+	// of a host, and have been asked to drain
+	Draining []int
+}
+
+// inheritedHost is a single instance of a host, with all instances of a host
+// sharing its Name
+type inheritedHost struct {
+	Name        string
+	Path        string
+	Args, Env   []string
+	Dir         string
+	PID         int
+	Started     time.Time
+	HTTP, HTTPS *inheritedTransfer
+}
+
+type inheritedTransfer struct {
+	FD    int
+	Ready bool
+	Conns int64
+}
+
+type upgradeListener interface {
+	net.Listener
+	file
+	SetDeadline(time.Time) error
+}
+
+// pause stops the accept loops while an upgrade is prepared
+type pause struct {
+	parked sync.WaitGroup
+	resume chan struct{}
+}
+
+// paused is called by an accept loop when accepting times out, parking the
+// loop until any current pause has ended, and returning whether there was one
+func (p *Proxy) paused() bool {
+	p.mu.RLock()
+	ps := p.pause
+	p.mu.RUnlock()
+	if ps == nil {
+		return false
+	}
+	ps.parked.Done()
+	<-ps.resume
+	return true
+}
+
+// Upgrade replaces the running program with a new copy of itself, from the same
+// path, passing it the listeners, along with the processes and transfer sockets
+// of the hosts, so that no connections are refused and the host processes keep
+// running.
+//
+// Accepting connections is paused while those currently being handled by the
+// proxy itself are finished; that is, connections for which it terminates TLS,
+// and requests it forwards in ModeReverseProxy, along with the pooled
+// connections they use to reach the hosts. Any that remain when the context is
+// done are dropped. Connections that have been passed to a host are unaffected.
+//
+// The output of the host processes must go to files, such as os.Stdout, or be
+// left nil to discard it, as any other io.Writer is fed by a pipe from this
+// process, which would be closed by the upgrade; hosts with such output cause
+// the upgrade to fail with ErrUpgradeOutput.
+//
+// The new copy of the program should call Resume to recreate the proxy, and
+// then recreate its hosts with NewHost or NewNamedHost, which will adopt the
+// running instances of the previous host with the same name if its command is
+// unchanged. Processes that are not adopted are drained once the proxy is
+// started.
+//
+// Upgrade only returns when the upgrade fails, in which case the proxy
+// continues as before.
+func (p *Proxy) Upgrade(ctx context.Context) error {
+	if !p.started {
+		return ErrNotRunning
+	}
+	var listeners []upgradeListener
+	for _, l := range [...]net.Listener{p.http, p.https} {
+		if l == nil {
+			continue
+		}
+		ul, ok := l.(upgradeListener)
+		if !ok {
+			return ErrUpgradeUnsupported
+		}
+		listeners = append(listeners, ul)
+	}
+	for _, h := range p.Hosts() {
+		if !h.upgradableOutput() {
+			return ErrUpgradeOutput{h.name}
+		}
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	if p.shutdown {
+		p.mu.Unlock()
+		return ErrNotRunning
+	} else if p.pause != nil {
+		p.mu.Unlock()
+		return ErrUpgrading
+	}
+	ps := &pause{resume: make(chan struct{})}
+	ps.parked.Add(len(listeners))
+	p.pause = ps
+	p.mu.Unlock()
+	defer p.resume(listeners, ps)
+	for _, l := range listeners {
+		l.SetDeadline(time.Unix(1, 0))
+	}
+	if !wait(ps.parked.Wait, p.closed) {
+		return ErrNotRunning
+	}
+	wait(p.active.Wait, ctx.Done())
+	p.mu.RLock()
+	shutdown := p.shutdown
+	p.mu.RUnlock()
+	if shutdown {
+		return ErrNotRunning
+	}
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	inherit := func(f file) (int, error) {
+		fl, err := f.File()
+		if err != nil {
+			return -1, err
+		}
+		files = append(files, fl)
+		return inheritable(fl)
+	}
+	state := upgradeState{
+		HTTP:  -1,
+		HTTPS: -1,
+	}
+	if p.http != nil {
+		if state.HTTP, err = inherit(p.http.(file)); err != nil {
+			return err
+		}
+	}
+	if p.https != nil {
+		if state.HTTPS, err = inherit(p.https.(file)); err != nil {
+			return err
+		}
+	}
+	current := make(map[*process]struct{})
+	for _, h := range p.Hosts() {
+		ihs, prs, err := h.upgradeState(inherit)
+		if err != nil {
+			return err
+		}
+		state.Hosts = append(state.Hosts, ihs...)
+		for _, pr := range prs {
+			current[pr] = struct{}{}
+		}
+	}
+	p.mu.RLock()
+	for pr := range p.processes {
+		if _, ok := current[pr]; !ok && !pr.exited() {
+			pr.sendDrain()
+			state.Draining = append(state.Draining, pr.pid())
+		}
+	}
+	p.mu.RUnlock()
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	env := os.Environ()
+	for n := 0; n < len(env); n++ {
+		if strings.HasPrefix(env[n], upgradeEnv+"=") {
+			env = append(env[:n], env[n+1:]...)
+			n--
+		}
+	}
+	return syscall.Exec(exe, os.Args, append(env, upgradeEnv+"="+string(data)))
+}
+
+// resume restarts the accept loops after a failed upgrade
+func (p *Proxy) resume(listeners []upgradeListener, ps *pause) {
+	for _, l := range listeners {
+		l.SetDeadline(time.Time{})
+	}
+	p.mu.Lock()
+	p.pause = nil
+	p.mu.Unlock()
+	close(ps.resume)
+}
+
+// wait calls the given function, returning true when it returns, or false if
+// the given channel is closed first
+func wait(fn func(), done <-chan struct{}) bool {
+	c := make(chan struct{})
+	go func() {
+		fn()
+		close(c)
+	}()
+	select {
+	case <-c:
+		return true
+	case <-done:
+		return false
+	}
+}
+
+// inheritable clears the close-on-exec flag of the file, returning its file
+// descriptor
+func inheritable(f *os.File) (int, error) {
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return -1, err
+	}
+	fd := -1
+	if cerr := rc.Control(func(u uintptr) {
+		if _, _, e := syscall.Syscall(syscall.SYS_FCNTL, u, syscall.F_SETFD, 0); e != 0 {
+			err = e
+			return
+		}
+		fd = int(u)
+	}); cerr != nil {
+		return -1, cerr
+	}
+	return fd, err
+}
+
+// upgradableOutput returns whether the output of the host processes can be
+// kept by the next copy of the program
+func (h *Host) upgradableOutput() bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for _, w := range [...]io.Writer{h.template.Stdout, h.template.Stderr} {
+		if w == nil {
+			continue
+		}
+		if _, ok := w.(*os.File); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// upgradeState returns the state of the running instances of the host, along
+// with their processes
+func (h *Host) upgradeState(inherit func(file) (int, error)) ([]*inheritedHost, []*process, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if h.stopped {
+		return nil, nil, nil
+	}
+	var (
+		ihs []*inheritedHost
+		prs []*process
+	)
+	for _, pr := range h.procs {
+		if pr.exited() {
+			continue
+		}
+		ih, err := h.instanceState(pr, inherit)
+		if err != nil {
+			return nil, nil, err
+		}
+		ihs = append(ihs, ih)
+		prs = append(prs, pr)
+	}
+	return ihs, prs, nil
+}
+
+// instanceState returns the state of a single instance of the host.
+//
+// Must be called with the lock held.
+func (h *Host) instanceState(pr *process, inherit func(file) (int, error)) (*inheritedHost, error) {
+	ih := &inheritedHost{
+		Name:    h.name,
+		Path:    h.template.Path,
+		Args:    h.template.Args,
+		Env:     h.template.Env,
+		Dir:     h.template.Dir,
+		PID:     pr.pid(),
+		Started: pr.started,
+	}
+	for _, t := range [...]struct {
+		t  *transfer
+		it **inheritedTransfer
+	}{
+		{pr.httpTransfer, &ih.HTTP},
+		{pr.httpsTransfer, &ih.HTTPS},
+	} {
+		if t.t == nil {
+			continue
+		}
+		fd, err := inherit(t.t.c)
+		if err != nil {
+			return nil, err
+		}
+		*t.it = &inheritedTransfer{
+			FD:    fd,
+			Ready: t.t.isReady(),
+			Conns: t.t.conns.Load(),
+		}
+	}
+	return ih, nil
+}
+
+// Resume recreates a Proxy from the state passed by Upgrade from the previous
+// copy of the program, returning nil if the program was not started by an
+// upgrade.
+func Resume() (*Proxy, error) {
+	data, ok := os.LookupEnv(upgradeEnv)
+	if !ok {
+		return nil, nil
+	}
+	os.Unsetenv(upgradeEnv)
+	var state upgradeState
+	if err := json.Unmarshal([]byte(data), &state); err != nil {
+		return nil, err
+	}
+	http, err := inheritListener(state.HTTP)
+	if err != nil {
+		return nil, err
+	}
+	https, err := inheritListener(state.HTTPS)
+	if err != nil {
+		if http != nil {
+			http.Close()
+		}
+		return nil, err
+	}
+	p := New(http, https)
+	if p == nil {
+		return nil, ErrNoListeners
+	}
+	p.inherited = make(map[string][]*inheritedHost, len(state.Hosts))
+	for _, ih := range state.Hosts {
+		p.inherited[ih.Name] = append(p.inherited[ih.Name], ih)
+	}
+	for _, pid := range state.Draining {
+		if pr, err := inheritProcess(&inheritedHost{PID: pid}); err == nil {
+			p.retire(pr)
+		}
+	}
+	return p, nil
+}
+
+func inheritListener(fd int) (net.Listener, error) {
+	if fd < 0 {
+		return nil, nil
+	}
+	f := os.NewFile(uintptr(fd), "")
+	defer f.Close()
+	return net.FileListener(f)
+}
+
+func inheritTransfer(it *inheritedTransfer) (*transfer, error) {
+	if it == nil {
+		return nil, nil
+	}
+	f := os.NewFile(uintptr(it.FD), "")
+	c, err := net.FileConn(f)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	uc, ok := c.(*net.UnixConn)
+	if !ok {
+		c.Close()
+		return nil, ErrBadSocket
+	}
+	t := &transfer{
+		c:     uc,
+		ready: make(chan struct{}),
+	}
+	if it.Ready {
+		t.markReady()
+	}
+	t.conns.Store(it.Conns)
+	go t.read()
+	return t, nil
+}
+
+// inheritProcess recreates a process, passed by Upgrade, which remains a child
+// of this process
+func inheritProcess(ih *inheritedHost) (*process, error) {
+	proc, err := os.FindProcess(ih.PID)
+	if err != nil {
+		return nil, err
+	}
+	pr := &process{
+		name: ih.Name,
+		cmd: &exec.Cmd{
+			Path:    ih.Path,
+			Args:    ih.Args,
+			Env:     ih.Env,
+			Dir:     ih.Dir,
+			Process: proc,
+		},
+		started: ih.Started,
+		done:    make(chan struct{}),
+	}
+	if pr.httpTransfer, err = inheritTransfer(ih.HTTP); err == nil {
+		pr.httpsTransfer, err = inheritTransfer(ih.HTTPS)
+	}
+	if err != nil {
+		pr.close()
+		return nil, err
+	}
+	return pr, nil
+}
+
+// inherit adopts the instances passed by Upgrade for the host with the same
+// name, skipping any whose command differs from the given one, which are
+// drained
+func (h *Host) inherit(c *exec.Cmd) []*process {
+	p := h.proxy
+	p.mu.Lock()
+	ihs := p.inherited[h.name]
+	delete(p.inherited, h.name)
+	p.mu.Unlock()
+	var prs []*process
+	for _, ih := range ihs {
+		pr, err := inheritProcess(ih)
+		if err != nil {
+			p.logf("host %s: error adopting process %d: %s\n", h.name, ih.PID, err)
+			continue
+		}
+		if ih.Path != c.Path || !sameStrings(ih.Args, c.Args) || !sameStrings(ih.Env, c.Env) || ih.Dir != c.Dir {
+			p.retire(pr)
+			continue
+		}
+		p.track(pr)
+		go h.watch(pr)
+		prs = append(prs, pr)
+	}
+	return prs
+}
+
+// retire drains an inherited process that has not been adopted by a host
+func (p *Proxy) retire(pr *process) {
+	p.track(pr)
+	go func() {
+		pr.reap()
+		p.untrack(pr)
+	}()
+	go pr.drain(DefaultDrainTimeout)
+}
+
+// stopInherited retires any inherited processes that were not adopted
+func (p *Proxy) stopInherited() {
+	p.mu.Lock()
+	inherited := p.inherited
+	p.inherited = nil
+	p.mu.Unlock()
+	for _, ihs := range inherited {
+		for _, ih := range ihs {
+			if pr, err := inheritProcess(ih); err == nil {
+				p.retire(pr)
+			}
+		}
+	}
+}
+
+func sameStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for n := range a {
+		if a[n] != b[n] {
+			return false
+		}
+	}
+	return true
+}
+
+// Errors
+var (
+	ErrUpgradeUnsupported = errors.New("listeners do not support upgrading")
+	ErrUpgrading          = errors.New("upgrade in progress")
+	ErrNoListeners        = errors.New("no listeners")
+)
+
+// ErrUpgradeOutput is an error returned by Upgrade when the output of a host
+// is not written to a file
+type ErrUpgradeOutput struct {
+	Name string
+}
+
+func (e ErrUpgradeOutput) Error() string {
+	return "host output cannot be upgraded: " + e.Name
+}
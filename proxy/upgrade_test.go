@@ -0,0 +1,31 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"os/exec"
+	"testing"
+)
+
+func TestUpgradableOutput(t *testing.T) {
+	p := newTestProxy(t)
+	for n, test := range [...]struct {
+		Stdout, Stderr io.Writer
+		Upgradable     bool
+	}{
+		{nil, nil, true},
+		{os.Stdout, os.Stderr, true},
+		{os.Stdout, nil, true},
+		{new(bytes.Buffer), nil, false},
+		{nil, new(bytes.Buffer), false},
+		{os.Stdout, io.Discard, false},
+	} {
+		h := newTestHost(t, p, "host")
+		h.template = &exec.Cmd{Stdout: test.Stdout, Stderr: test.Stderr}
+		if upgradable := h.upgradableOutput(); upgradable != test.Upgradable {
+			t.Errorf("test %d: expecting upgradable %v, got %v", n+1, test.Upgradable, upgradable)
+		}
+		p.removeHost(h)
+	}
+}
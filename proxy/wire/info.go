@@ -0,0 +1,182 @@
+package wire
+
+import (
+	"encoding/binary"
+	"net"
+	"strconv"
+	"time"
+)
+
+// Listener identifies the proxy listener that accepted a connection
+type Listener uint8
+
+// Listeners
+const (
+	ListenerHTTP Listener = iota
+	ListenerHTTPS
+)
+
+func (l Listener) String() string {
+	switch l {
+	case ListenerHTTP:
+		return "http"
+	case ListenerHTTPS:
+		return "https"
+	}
+	return "unknown"
+}
+
+// ConnInfo contains the information the proxy has about a connection.
+//
+// It is encoded as a series of fields, each consisting of a one byte tag, a
+// little endian uint16 length and the value. Unknown tags are skipped when
+// decoding so that new fields can be added without breaking older clients.
+type ConnInfo struct {
+	// Listener is the proxy listener that accepted the connection
+	Listener Listener
+	// Hostname is the name that was used to route the connection, taken
+	// from either the Host header or the TLS server name
+	Hostname string
+	// Alias is the host alias that matched the Hostname, including any
+	// path prefix, which will be empty if the connection was sent to the
+	// default host
+	Alias string
+	// ServerName is the server name sent in the TLS ClientHello
+	ServerName string
+	// ALPN lists the protocols offered in the TLS ClientHello
+	ALPN []string
+	// Accepted is the time the proxy accepted the connection
+	Accepted time.Time
+	// RemoteAddr and LocalAddr are the addresses of the original
+	// connection
+	RemoteAddr, LocalAddr net.Addr
+	// TLS is set when the proxy terminated TLS on the original connection
+	// and is passing on the decrypted stream
+	TLS bool
+}
+
+const (
+	tagListener uint8 = iota + 1
+	tagHostname
+	tagAlias
+	tagServerName
+	tagALPN
+	tagAccepted
+	tagRemoteAddr
+	tagLocalAddr
+	tagTLS
+)
+
+type fieldWriter []byte
+
+func (f *fieldWriter) write(tag uint8, value []byte) {
+	*f = append(*f, tag, 0, 0)
+	binary.LittleEndian.PutUint16((*f)[len(*f)-2:], uint16(len(value)))
+	*f = append(*f, value...)
+}
+
+func (f *fieldWriter) writeString(tag uint8, value string) {
+	if value != "" {
+		f.write(tag, []byte(value))
+	}
+}
+
+func (f *fieldWriter) writeAddr(tag uint8, addr net.Addr) {
+	if addr != nil {
+		f.writeString(tag, addr.String())
+	}
+}
+
+// MarshalBinary implements the encoding.BinaryMarshaler interface
+func (c *ConnInfo) MarshalBinary() ([]byte, error) {
+	var f fieldWriter
+	f.write(tagListener, []byte{byte(c.Listener)})
+	f.writeString(tagHostname, c.Hostname)
+	f.writeString(tagAlias, c.Alias)
+	f.writeString(tagServerName, c.ServerName)
+	for _, proto := range c.ALPN {
+		f.writeString(tagALPN, proto)
+	}
+	if !c.Accepted.IsZero() {
+		var t [8]byte
+		binary.LittleEndian.PutUint64(t[:], uint64(c.Accepted.UnixNano()))
+		f.write(tagAccepted, t[:])
+	}
+	f.writeAddr(tagRemoteAddr, c.RemoteAddr)
+	f.writeAddr(tagLocalAddr, c.LocalAddr)
+	if c.TLS {
+		f.write(tagTLS, nil)
+	}
+	return f, nil
+}
+
+// UnmarshalBinary implements the encoding.BinaryUnmarshaler interface
+func (c *ConnInfo) UnmarshalBinary(data []byte) error {
+	*c = ConnInfo{}
+	for len(data) > 0 {
+		if len(data) < 3 {
+			return ErrInvalidMeta
+		}
+		tag := data[0]
+		length := int(binary.LittleEndian.Uint16(data[1:3]))
+		data = data[3:]
+		if len(data) < length {
+			return ErrInvalidMeta
+		}
+		value := data[:length]
+		data = data[length:]
+		switch tag {
+		case tagListener:
+			if length != 1 {
+				return ErrInvalidMeta
+			}
+			c.Listener = Listener(value[0])
+		case tagHostname:
+			c.Hostname = string(value)
+		case tagAlias:
+			c.Alias = string(value)
+		case tagServerName:
+			c.ServerName = string(value)
+		case tagALPN:
+			c.ALPN = append(c.ALPN, string(value))
+		case tagAccepted:
+			if length != 8 {
+				return ErrInvalidMeta
+			}
+			c.Accepted = time.Unix(0, int64(binary.LittleEndian.Uint64(value)))
+		case tagRemoteAddr:
+			c.RemoteAddr = parseAddr(string(value))
+		case tagLocalAddr:
+			c.LocalAddr = parseAddr(string(value))
+		case tagTLS:
+			c.TLS = true
+		}
+	}
+	return nil
+}
+
+func parseAddr(addr string) net.Addr {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return Addr(addr)
+	}
+	ip := net.ParseIP(host)
+	p, err := strconv.ParseUint(port, 10, 16)
+	if ip == nil || err != nil {
+		return Addr(addr)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(p)}
+}
+
+// Addr is a net.Addr used for addresses that cannot be parsed as TCP
+// addresses
+type Addr string
+
+// Network implements the net.Addr interface
+func (Addr) Network() string {
+	return ""
+}
+
+func (a Addr) String() string {
+	return string(a)
+}
@@ -0,0 +1,78 @@
+package wire
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestConnInfoRoundTrip(t *testing.T) {
+	for n, test := range [...]ConnInfo{
+		{},
+		{
+			Listener: ListenerHTTPS,
+		},
+		{
+			Listener:   ListenerHTTP,
+			Hostname:   "www.example.com",
+			Alias:      "*.example.com/api/",
+			Accepted:   time.Unix(1234567890, 123456789),
+			RemoteAddr: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 54321},
+			LocalAddr:  &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 80},
+		},
+		{
+			Listener:   ListenerHTTPS,
+			Hostname:   "example.com",
+			ServerName: "example.com",
+			ALPN:       []string{"h2", "http/1.1"},
+			RemoteAddr: Addr("@"),
+			TLS:        true,
+		},
+	} {
+		data, err := test.MarshalBinary()
+		if err != nil {
+			t.Errorf("test %d: unexpected error marshaling: %s", n+1, err)
+			continue
+		}
+		var got ConnInfo
+		if err = got.UnmarshalBinary(data); err != nil {
+			t.Errorf("test %d: unexpected error unmarshaling: %s", n+1, err)
+		} else if !reflect.DeepEqual(got, test) {
+			t.Errorf("test %d: expecting %#v, got %#v", n+1, test, got)
+		}
+	}
+}
+
+func TestConnInfoUnknownTags(t *testing.T) {
+	want := ConnInfo{
+		Listener: ListenerHTTPS,
+		Hostname: "example.com",
+	}
+	data, _ := want.MarshalBinary()
+	data = append([]byte{200, 3, 0, 'a', 'b', 'c'}, data...)
+	data = append(data, 201, 0, 0)
+	var got ConnInfo
+	if err := got.UnmarshalBinary(data); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expecting %#v, got %#v", want, got)
+	}
+}
+
+func TestConnInfoInvalid(t *testing.T) {
+	for n, test := range [...][]byte{
+		{tagHostname},
+		{tagHostname, 1},
+		{tagHostname, 5, 0, 'a'},
+		{tagListener, 2, 0, 0, 0},
+		{tagListener, 0, 0},
+		{tagAccepted, 4, 0, 0, 0, 0, 0},
+	} {
+		var c ConnInfo
+		if err := c.UnmarshalBinary(test); err != ErrInvalidMeta {
+			t.Errorf("test %d: expecting ErrInvalidMeta, got %v", n+1, err)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+// Package wire contains the framing used to pass connections, and information
+// about them, from the proxy to its clients over a transfer socket.
+package wire // import "vimagination.zapto.org/webserver/proxy/wire"
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"syscall"
+)
+
+// Version is the current version of the framing protocol
+const Version = 1
+
+// HeaderSize is the length of the fixed header that starts every message
+const HeaderSize = 8
+
+// Type represents the type of a message sent over a transfer socket
+type Type uint8
+
+// Message types
+const (
+	// TypeConn messages carry a file descriptor for a connection, the
+	// connection information and any bytes already read from the connection
+	TypeConn Type = 1
+	// TypeReady messages are sent by a client to tell the proxy that it is
+	// ready to receive connections
+	TypeReady Type = 2
+	// TypeDrain messages are sent by the proxy to tell a client to stop
+	// accepting connections and to exit once its current connections are
+	// finished
+	TypeDrain Type = 3
+	// TypeClosed messages are sent by a client to tell the proxy that one
+	// of the connections passed to it has been closed, allowing the proxy
+	// to track how many connections each client is handling
+	TypeClosed Type = 4
+)
+
+// Header is the fixed length header that starts every message.
+//
+// It is encoded as the protocol version, the message type, the length of the
+// metadata as a little endian uint16, and the length of the data as a little
+// endian uint32.
+type Header struct {
+	Type       Type
+	MetaLength uint16
+	DataLength uint32
+}
+
+func (h Header) bytes() []byte {
+	b := make([]byte, HeaderSize)
+	b[0] = Version
+	b[1] = byte(h.Type)
+	binary.LittleEndian.PutUint16(b[2:4], h.MetaLength)
+	binary.LittleEndian.PutUint32(b[4:8], h.DataLength)
+	return b
+}
+
+func parseHeader(b []byte) (Header, error) {
+	if b[0] != Version {
+		return Header{}, ErrUnsupportedVersion
+	}
+	return Header{
+		Type:       Type(b[1]),
+		MetaLength: binary.LittleEndian.Uint16(b[2:4]),
+		DataLength: binary.LittleEndian.Uint32(b[4:8]),
+	}, nil
+}
+
+// Message represents a single message read from a transfer socket
+type Message struct {
+	Type Type
+	File *os.File
+	Info ConnInfo
+	Data []byte
+}
+
+// WriteConn sends the file descriptor of the given file, along with the
+// connection information and any already read data, over the unix socket.
+func WriteConn(u *net.UnixConn, f *os.File, info *ConnInfo, data []byte) error {
+	meta, err := info.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	if len(meta) > 0xffff {
+		return ErrMetaTooLarge
+	}
+	h := Header{
+		Type:       TypeConn,
+		MetaLength: uint16(len(meta)),
+		DataLength: uint32(len(data)),
+	}
+	if _, _, err = u.WriteMsgUnix(h.bytes(), syscall.UnixRights(int(f.Fd())), nil); err != nil {
+		return err
+	}
+	if _, err = u.Write(meta); err != nil {
+		return err
+	}
+	_, err = u.Write(data)
+	return err
+}
+
+// WriteControl sends a message of the given type that has no data, such as
+// TypeReady, TypeDrain or TypeClosed
+func WriteControl(u *net.UnixConn, t Type) error {
+	_, err := u.Write(Header{Type: t}.bytes())
+	return err
+}
+
+// Read reads a single message from the unix socket.
+//
+// Messages of an unknown type are returned with their metadata and data
+// unparsed so that they can be ignored by the caller.
+func Read(u *net.UnixConn) (*Message, error) {
+	header := make([]byte, HeaderSize)
+	oob := make([]byte, syscall.CmsgSpace(4))
+	n, oobn, _, _, err := u.ReadMsgUnix(header, oob)
+	if err != nil {
+		return nil, err
+	}
+	var f *os.File
+	if oobn > 0 {
+		msg, err := syscall.ParseSocketControlMessage(oob[:oobn])
+		if err != nil {
+			return nil, err
+		}
+		if len(msg) != 1 {
+			return nil, ErrInvalidSCM
+		}
+		fds, err := syscall.ParseUnixRights(&msg[0])
+		if err != nil {
+			return nil, err
+		}
+		if len(fds) != 1 {
+			for _, fd := range fds {
+				syscall.Close(fd)
+			}
+			return nil, ErrInvalidFDs
+		}
+		f = os.NewFile(uintptr(fds[0]), "")
+	}
+	m, err := readMessage(u, header, n)
+	if err != nil {
+		if f != nil {
+			f.Close()
+		}
+		return nil, err
+	}
+	m.File = f
+	if m.Type == TypeConn && f == nil {
+		return nil, ErrInvalidFDs
+	}
+	return m, nil
+}
+
+func readMessage(r io.Reader, header []byte, n int) (*Message, error) {
+	if n < len(header) {
+		if _, err := io.ReadFull(r, header[n:]); err != nil {
+			return nil, err
+		}
+	}
+	h, err := parseHeader(header)
+	if err != nil {
+		return nil, err
+	}
+	meta := make([]byte, h.MetaLength)
+	if _, err = io.ReadFull(r, meta); err != nil {
+		return nil, err
+	}
+	m := &Message{
+		Type: h.Type,
+		Data: make([]byte, h.DataLength),
+	}
+	if _, err = io.ReadFull(r, m.Data); err != nil {
+		return nil, err
+	}
+	if h.Type == TypeConn {
+		if err = m.Info.UnmarshalBinary(meta); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// Errors
+var (
+	ErrUnsupportedVersion = errors.New("unsupported protocol version")
+	ErrMetaTooLarge       = errors.New("connection information too large")
+	ErrInvalidMeta        = errors.New("invalid connection information")
+	ErrInvalidSCM         = errors.New("invalid number of socket control messages")
+	ErrInvalidFDs         = errors.New("invalid number of file descriptors")
+)
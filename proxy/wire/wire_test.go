@@ -0,0 +1,149 @@
+package wire
+
+import (
+	"io"
+	"net"
+	"os"
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+func socketPair(t *testing.T) (*net.UnixConn, *net.UnixConn) {
+	t.Helper()
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatalf("unexpected error creating socket pair: %s", err)
+	}
+	var conns [2]*net.UnixConn
+	for n, fd := range fds {
+		f := os.NewFile(uintptr(fd), "")
+		c, err := net.FileConn(f)
+		f.Close()
+		if err != nil {
+			t.Fatalf("unexpected error creating connection: %s", err)
+		}
+		conns[n] = c.(*net.UnixConn)
+		t.Cleanup(func() { c.Close() })
+	}
+	return conns[0], conns[1]
+}
+
+func TestWriteConnRead(t *testing.T) {
+	a, b := socketPair(t)
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("unexpected error creating pipe: %s", err)
+	}
+	defer r.Close()
+	defer w.Close()
+	info := ConnInfo{
+		Listener: ListenerHTTPS,
+		Hostname: "example.com",
+		ALPN:     []string{"http/1.1"},
+	}
+	data := []byte("GET / HTTP/1.1\r\n")
+	if err = WriteConn(a, w, &info, data); err != nil {
+		t.Fatalf("unexpected error writing: %s", err)
+	}
+	m, err := Read(b)
+	if err != nil {
+		t.Fatalf("unexpected error reading: %s", err)
+	}
+	if m.Type != TypeConn {
+		t.Errorf("expecting type %d, got %d", TypeConn, m.Type)
+	}
+	if !reflect.DeepEqual(m.Info, info) {
+		t.Errorf("expecting info %#v, got %#v", info, m.Info)
+	}
+	if string(m.Data) != string(data) {
+		t.Errorf("expecting data %q, got %q", data, m.Data)
+	}
+	if m.File == nil {
+		t.Fatal("expecting file, got nil")
+	}
+	defer m.File.Close()
+	if _, err = m.File.Write([]byte("hello")); err != nil {
+		t.Fatalf("unexpected error writing to passed file: %s", err)
+	}
+	buf := make([]byte, 5)
+	if _, err = io.ReadFull(r, buf); err != nil {
+		t.Fatalf("unexpected error reading from pipe: %s", err)
+	} else if string(buf) != "hello" {
+		t.Errorf("expecting to read %q, got %q", "hello", buf)
+	}
+}
+
+func TestWriteControlRead(t *testing.T) {
+	a, b := socketPair(t)
+	for _, typ := range [...]Type{TypeReady, TypeDrain, TypeClosed} {
+		if err := WriteControl(a, typ); err != nil {
+			t.Fatalf("unexpected error writing type %d: %s", typ, err)
+		}
+		m, err := Read(b)
+		if err != nil {
+			t.Fatalf("unexpected error reading type %d: %s", typ, err)
+		}
+		if m.Type != typ || m.File != nil || len(m.Data) != 0 {
+			t.Errorf("expecting empty message of type %d, got %#v", typ, m)
+		}
+	}
+}
+
+func TestReadUnknownType(t *testing.T) {
+	a, b := socketPair(t)
+	msg := Header{Type: 200, MetaLength: 2, DataLength: 3}.bytes()
+	msg = append(msg, 1, 2, 'a', 'b', 'c')
+	if _, err := a.Write(msg); err != nil {
+		t.Fatalf("unexpected error writing: %s", err)
+	}
+	if err := WriteControl(a, TypeReady); err != nil {
+		t.Fatalf("unexpected error writing: %s", err)
+	}
+	m, err := Read(b)
+	if err != nil {
+		t.Fatalf("unexpected error reading: %s", err)
+	}
+	if m.Type != 200 || string(m.Data) != "abc" {
+		t.Errorf("expecting unknown message with data %q, got %#v", "abc", m)
+	}
+	if m, err = Read(b); err != nil {
+		t.Fatalf("unexpected error reading: %s", err)
+	} else if m.Type != TypeReady {
+		t.Errorf("expecting type %d after unknown message, got %d", TypeReady, m.Type)
+	}
+}
+
+func TestReadVersion(t *testing.T) {
+	a, b := socketPair(t)
+	msg := Header{Type: TypeReady}.bytes()
+	msg[0] = Version + 1
+	if _, err := a.Write(msg); err != nil {
+		t.Fatalf("unexpected error writing: %s", err)
+	}
+	if _, err := Read(b); err != ErrUnsupportedVersion {
+		t.Errorf("expecting ErrUnsupportedVersion, got %v", err)
+	}
+}
+
+func TestReadConnWithoutFile(t *testing.T) {
+	a, b := socketPair(t)
+	if _, err := a.Write(Header{Type: TypeConn}.bytes()); err != nil {
+		t.Fatalf("unexpected error writing: %s", err)
+	}
+	if _, err := Read(b); err != ErrInvalidFDs {
+		t.Errorf("expecting ErrInvalidFDs, got %v", err)
+	}
+}
+
+func TestReadTruncated(t *testing.T) {
+	a, b := socketPair(t)
+	msg := Header{Type: TypeConn, DataLength: 10}.bytes()
+	if _, err := a.Write(append(msg, "abc"...)); err != nil {
+		t.Fatalf("unexpected error writing: %s", err)
+	}
+	a.Close()
+	if _, err := Read(b); err != io.ErrUnexpectedEOF {
+		t.Errorf("expecting io.ErrUnexpectedEOF, got %v", err)
+	}
+}
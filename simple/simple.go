@@ -8,7 +8,6 @@ import (
 	"net/http"
 	"net/smtp"
 	"os"
-	"os/signal"
 	"path"
 	"strings"
 
@@ -28,6 +27,7 @@ var (
 	logName     = flag.String("n", "", "name for logging")
 	logFile     = flag.String("l", "", "filename for request logging")
 	serverName  = flag.String("s", "", "server name for HTTPS")
+	redirect    = flag.Bool("t", false, "redirect HTTP to HTTPS when the proxy handles TLS")
 	logger      *log.Logger
 )
 
@@ -36,7 +36,7 @@ type http2https struct {
 }
 
 func (hh http2https) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if r.TLS == nil {
+	if info := client.ConnInfo(r); r.TLS == nil && (info == nil || !info.TLS) {
 		var url = "https://" + r.Host + r.URL.Path
 		if len(r.URL.RawQuery) != 0 {
 			url += "?" + r.URL.RawQuery
@@ -103,6 +103,8 @@ func main() {
 			GetCertificate: leManager.GetCertificate,
 			NextProtos:     []string{"h2", "http/1.1"},
 		}
+	} else if *redirect {
+		server.Handler = http2https{server.Handler}
 	}
 	if *logFile != "" {
 		var err error
@@ -122,32 +124,12 @@ func main() {
 		logger.Fatalf("error setting up server: %s\n", err)
 	}
 
-	cc := make(chan struct{})
-	go func() {
-		logger.Println("Server Started")
-		sc := make(chan os.Signal, 1)
-		signal.Notify(sc, os.Interrupt)
-		select {
-		case <-sc:
-			logger.Println("Closing")
-		case <-cc:
-		}
-		signal.Stop(sc)
-		close(sc)
-		client.Close()
-		client.Wait()
-		close(cc)
-	}()
+	logger.Println("Server Started")
 	err := client.Run()
 	if lFile != nil {
 		lFile.Close()
 	}
-
-	select {
-	case <-cc:
-	default:
+	if err != nil {
 		logger.Println(err)
-		cc <- struct{}{}
 	}
-	<-cc
 }
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"vimagination.zapto.org/webserver/proxy"
+)
+
+// server manages the hosts run by the proxy, applying changes to the
+// configured sites
+type server struct {
+	proxy *proxy.Proxy
+	certs *certManager
+
+	mu    sync.Mutex
+	sites map[string]*site
+}
+
+type site struct {
+	Site
+	host *proxy.Host
+}
+
+func newServer(p *proxy.Proxy, certs *certManager) *server {
+	return &server{
+		proxy: p,
+		certs: certs,
+		sites: make(map[string]*site),
+	}
+}
+
+func readConfig(path string) (*Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	config := new(Config)
+	if err = json.NewDecoder(f).Decode(config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// validate checks the sites of a configuration for errors, so that a bad
+// configuration is never partially applied
+func (c *Config) validate() error {
+	if len(c.Sites) == 0 {
+		return ErrNoSites
+	}
+	var (
+		names    = make(map[string]struct{}, len(c.Sites))
+		aliases  = make(map[string]siteAlias)
+		defaults int
+	)
+	for _, s := range c.Sites {
+		if s.Name == "" {
+			return ErrNoName
+		}
+		if _, ok := names[s.Name]; ok {
+			return fmt.Errorf("duplicate site name: %q", s.Name)
+		}
+		names[s.Name] = struct{}{}
+		if s.Cmd == "" {
+			return fmt.Errorf("no command for site %q", s.Name)
+		}
+		if _, err := s.restartPolicy(); err != nil {
+			return fmt.Errorf("site %q: %w", s.Name, err)
+		}
+		if _, err := s.balance(); err != nil {
+			return fmt.Errorf("site %q: %w", s.Name, err)
+		}
+		if s.Instances < 0 {
+			return fmt.Errorf("invalid number of instances for site %q: %d", s.Name, s.Instances)
+		}
+		if s.CPU < 0 || s.Memory < 0 || s.Pids < 0 || s.Files < 0 {
+			return fmt.Errorf("negative limit for site %q", s.Name)
+		}
+		if s.Pids > 0 && c.Cgroup == "" && (s.Uid == 0 || s.Gid == 0) {
+			return fmt.Errorf("pids limit for site %q needs a cgroup or its own user", s.Name)
+		}
+		for _, alias := range s.Aliases {
+			if !proxy.ValidAlias(alias) {
+				return fmt.Errorf("invalid alias for site %q: %q", s.Name, alias)
+			}
+			key := proxy.AliasKey(alias)
+			if other, ok := aliases[key]; ok {
+				return fmt.Errorf("alias %q of site %q overlaps alias %q of site %q", alias, s.Name, other.alias, other.site)
+			}
+			aliases[key] = siteAlias{site: s.Name, alias: alias}
+		}
+		if s.Default {
+			defaults++
+		}
+	}
+	if defaults != 1 {
+		return ErrDefaults
+	}
+	for _, s := range c.Sites {
+		if s.HealthCheck != nil && s.HealthCheck.Fallback != "" {
+			if _, ok := names[s.HealthCheck.Fallback]; !ok {
+				return fmt.Errorf("unknown fallback for site %q: %q", s.Name, s.HealthCheck.Fallback)
+			}
+		}
+	}
+	return nil
+}
+
+type siteAlias struct {
+	site, alias string
+}
+
+// commandChanged returns whether the running process would need to be replaced
+// to apply the new site configuration
+func (s *Site) commandChanged(n *Site) bool {
+	return s.Cmd != n.Cmd || !equalStrings(s.Arguments, n.Arguments) || s.WorkingDir != n.WorkingDir || !equalStrings(s.Env, n.Env) || s.Uid != n.Uid || s.Gid != n.Gid
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for n := range a {
+		if a[n] != b[n] {
+			return false
+		}
+	}
+	return true
+}
+
+// difference returns the strings in a that are not in b
+func difference(a, b []string) []string {
+	var d []string
+Loop:
+	for _, s := range a {
+		for _, t := range b {
+			if s == t {
+				continue Loop
+			}
+		}
+		d = append(d, s)
+	}
+	return d
+}
+
+// reload reads the configuration file and applies it, leaving the current
+// sites untouched if it is invalid
+func (s *server) reload(path string) error {
+	config, err := readConfig(path)
+	if err != nil {
+		return err
+	}
+	return s.apply(config)
+}
+
+// apply updates the running sites to match the given configuration.
+//
+// New sites are started, removed sites are stopped, and sites with a changed
+// command are replaced. Other changes, including to aliases, are applied
+// without affecting the running processes.
+//
+// The configuration is checked before any changes are made, with an invalid
+// one being rejected. Otherwise, all of the changes that can be made are, with
+// the errors for the rest returned as ErrSites.
+func (s *server) apply(config *Config) error {
+	if err := config.validate(); err != nil {
+		return err
+	}
+	if err := s.certs.update(config.Sites); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var errs ErrSites
+	configured := make(map[string]*Site, len(config.Sites))
+	for n := range config.Sites {
+		configured[config.Sites[n].Name] = &config.Sites[n]
+	}
+	for name, st := range s.sites {
+		aliases := st.host.Aliases()
+		if ns, ok := configured[name]; ok {
+			aliases = difference(aliases, ns.Aliases)
+		}
+		if len(aliases) > 0 {
+			if err := st.host.RemoveAlias(aliases...); err != nil {
+				errs = append(errs, fmt.Errorf("error removing aliases from site %q: %w", name, err))
+			}
+		}
+	}
+	for _, ns := range config.Sites {
+		st, ok := s.sites[ns.Name]
+		if !ok {
+			newHost := s.proxy.NewNamedHost
+			if ns.OnDemand {
+				newHost = s.proxy.NewOnDemandHost
+			}
+			host, err := newHost(ns.Name, ns.command())
+			if err != nil {
+				errs = append(errs, fmt.Errorf("error adding site %q: %w", ns.Name, err))
+				continue
+			}
+			s.sites[ns.Name] = &site{Site: ns, host: host}
+			continue
+		}
+		if st.commandChanged(&ns) {
+			if err := st.host.Replace(ns.command()); err != nil {
+				errs = append(errs, fmt.Errorf("error replacing site %q: %w", ns.Name, err))
+				// keep the old command so that the replace is retried
+				// on the next reload
+				ns.Cmd, ns.Arguments, ns.WorkingDir, ns.Env, ns.Uid, ns.Gid = st.Cmd, st.Arguments, st.WorkingDir, st.Env, st.Uid, st.Gid
+			}
+		}
+		if st.OnDemand != ns.OnDemand {
+			if err := st.host.SetOnDemand(ns.OnDemand); err != nil {
+				errs = append(errs, fmt.Errorf("error starting site %q: %w", ns.Name, err))
+				ns.OnDemand = st.OnDemand
+			}
+		}
+		st.Site = ns
+	}
+	for _, ns := range config.Sites {
+		st, ok := s.sites[ns.Name]
+		if !ok {
+			continue
+		}
+		if aliases := difference(ns.Aliases, st.host.Aliases()); len(aliases) > 0 {
+			if err := st.host.AddAliases(aliases...); err != nil {
+				errs = append(errs, fmt.Errorf("error adding aliases to site %q: %w", ns.Name, err))
+			}
+		}
+		if ns.Default {
+			if err := s.proxy.Default(st.host); err != nil {
+				errs = append(errs, fmt.Errorf("error setting default site %q: %w", ns.Name, err))
+			}
+		}
+		errs = append(errs, s.configure(st)...)
+	}
+	for name, st := range s.sites {
+		if _, ok := configured[name]; ok {
+			continue
+		}
+		if err := s.proxy.RemoveHost(st.host); err != nil {
+			errs = append(errs, fmt.Errorf("error removing site %q: %w", name, err))
+		}
+		delete(s.sites, name)
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// configure applies the settings of a site that do not require the process to
+// be replaced, returning the errors for any that could not be.
+//
+// Must be called with the lock held.
+func (s *server) configure(st *site) []error {
+	var errs []error
+	policy, _ := st.restartPolicy()
+	st.host.SetRestartPolicy(policy)
+	st.host.SetReadiness(!st.NoReadiness)
+	st.host.SetTimeouts(time.Duration(st.StartTimeout), time.Duration(st.DrainTimeout))
+	st.host.SetIdleTimeout(time.Duration(st.IdleTimeout))
+	if err := st.host.SetLimits(proxy.Limits{
+		CPU:    st.CPU,
+		Memory: st.Memory,
+		Pids:   st.Pids,
+		Files:  st.Files,
+	}); err != nil {
+		errs = append(errs, fmt.Errorf("error setting limits of site %q: %w", st.Name, err))
+	}
+	balance, _ := st.balance()
+	st.host.SetBalance(balance)
+	if err := st.host.SetInstances(st.Instances); err != nil {
+		errs = append(errs, fmt.Errorf("error setting instances of site %q: %w", st.Name, err))
+	}
+	if st.TerminateTLS {
+		st.host.TerminateTLS(s.certs.tlsConfig(st.Name))
+	} else {
+		st.host.TerminateTLS(nil)
+	}
+	var hc proxy.HealthCheck
+	if st.HealthCheck != nil {
+		hc = proxy.HealthCheck{
+			Path:     st.HealthCheck.Path,
+			Addr:     st.HealthCheck.Addr,
+			Interval: time.Duration(st.HealthCheck.Interval),
+			Timeout:  time.Duration(st.HealthCheck.Timeout),
+			Failures: st.HealthCheck.Failures,
+			Status:   st.HealthCheck.Status,
+		}
+		if fallback, ok := s.sites[st.HealthCheck.Fallback]; ok {
+			hc.Fallback = fallback.host
+		}
+	}
+	if err := st.host.SetHealthCheck(hc); err != nil {
+		errs = append(errs, fmt.Errorf("error setting health check of site %q: %w", st.Name, err))
+	}
+	return errs
+}
+
+// ErrSites is returned when a valid configuration could not be fully applied,
+// with an error for each change to the sites that failed
+type ErrSites []error
+
+func (e ErrSites) Error() string {
+	msgs := make([]string, len(e))
+	for n, err := range e {
+		msgs[n] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func (e ErrSites) Unwrap() []error {
+	return e
+}
+
+// Errors
+var (
+	ErrNoSites  = errors.New("no sites configured")
+	ErrNoName   = errors.New("site with no name")
+	ErrDefaults = errors.New("exactly one site must be the default")
+)
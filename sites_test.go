@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"vimagination.zapto.org/webserver/proxy"
+)
+
+func TestValidate(t *testing.T) {
+	site := func(name string, aliases ...string) Site {
+		return Site{Name: name, Cmd: "sleep", Aliases: aliases}
+	}
+	def := func(s Site) Site {
+		s.Default = true
+		return s
+	}
+	for n, test := range [...]struct {
+		Sites []Site
+		Err   string
+	}{
+		{
+			Sites: []Site{def(site("a", "a.example.com")), site("b", "b.example.com")},
+		},
+		{
+			Err: "no sites configured",
+		},
+		{
+			Sites: []Site{site("a")},
+			Err:   "exactly one site must be the default",
+		},
+		{
+			Sites: []Site{def(site("a")), site("a")},
+			Err:   `duplicate site name: "a"`,
+		},
+		{
+			Sites: []Site{def(site("a", "www.*.example.com"))},
+			Err:   `invalid alias for site "a": "www.*.example.com"`,
+		},
+		{
+			Sites: []Site{def(site("a", "*")), site("b")},
+			Err:   `invalid alias for site "a": "*"`,
+		},
+		{
+			Sites: []Site{def(site("a", "www.example.com")), site("b", "www.example.com")},
+			Err:   `alias "www.example.com" of site "b" overlaps alias "www.example.com" of site "a"`,
+		},
+		{
+			Sites: []Site{def(site("a", "*.example.com")), site("b", ".example.com")},
+			Err:   `alias ".example.com" of site "b" overlaps alias "*.example.com" of site "a"`,
+		},
+		{
+			Sites: []Site{def(site("a", ".example.com/api/")), site("b", "*.example.com/api/")},
+			Err:   `alias "*.example.com/api/" of site "b" overlaps alias ".example.com/api/" of site "a"`,
+		},
+		{
+			Sites: []Site{def(site("a", "*.example.com", ".example.com"))},
+			Err:   `alias ".example.com" of site "a" overlaps alias "*.example.com" of site "a"`,
+		},
+		{
+			Sites: []Site{def(site("a", "*.example.com", "example.com", ".example.com/api/")), site("b", "www.example.com", "example.com/api/")},
+		},
+		{
+			Sites: []Site{def(site("a")), {Name: "b", Cmd: "sleep", HealthCheck: &HealthCheck{Fallback: "c"}}},
+			Err:   `unknown fallback for site "b": "c"`,
+		},
+	} {
+		err := (&Config{Sites: test.Sites}).validate()
+		if test.Err == "" && err != nil {
+			t.Errorf("test %d: unexpected error: %s", n+1, err)
+		} else if test.Err != "" && (err == nil || err.Error() != test.Err) {
+			t.Errorf("test %d: expecting error %q, got %v", n+1, test.Err, err)
+		}
+	}
+}
+
+func TestApply(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error listening: %s", err)
+	}
+	p := proxy.New(l, nil)
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		p.Shutdown(ctx)
+		cancel()
+	}()
+	s := newServer(p, newCertManager(nil))
+	site := func(name string, onDemand bool, arg string, aliases ...string) Site {
+		return Site{
+			Name:         name,
+			Default:      name == "a",
+			Aliases:      aliases,
+			Cmd:          "sleep",
+			Arguments:    []string{arg},
+			OnDemand:     onDemand,
+			NoReadiness:  true,
+			DrainTimeout: Duration(time.Second),
+		}
+	}
+	for n, test := range [...]struct {
+		Sites    []Site
+		Err      string
+		Aliases  map[string][]string
+		Idle     []string
+		Replaced []string
+	}{
+		{ // add
+			Sites:   []Site{site("a", false, "60", "a.example.com"), site("b", true, "60", "b.example.com")},
+			Aliases: map[string][]string{"a": {"a.example.com"}, "b": {"b.example.com"}},
+			Idle:    []string{"b"},
+		},
+		{ // no change
+			Sites:   []Site{site("a", false, "60", "a.example.com"), site("b", true, "60", "b.example.com")},
+			Aliases: map[string][]string{"a": {"a.example.com"}, "b": {"b.example.com"}},
+			Idle:    []string{"b"},
+		},
+		{ // move an alias and start on-demand site
+			Sites:   []Site{site("a", false, "60", "a.example.com", "b.example.com"), site("b", false, "60", "*.b.example.com")},
+			Aliases: map[string][]string{"a": {"a.example.com", "b.example.com"}, "b": {"*.b.example.com"}},
+		},
+		{ // command change
+			Sites:    []Site{site("a", false, "61", "a.example.com", "b.example.com"), site("b", false, "60", "*.b.example.com")},
+			Aliases:  map[string][]string{"a": {"a.example.com", "b.example.com"}, "b": {"*.b.example.com"}},
+			Replaced: []string{"a"},
+		},
+		{ // rename
+			Sites:   []Site{site("a", false, "61", "a.example.com"), site("c", false, "60", "b.example.com", "*.b.example.com")},
+			Aliases: map[string][]string{"a": {"a.example.com"}, "c": {"*.b.example.com", "b.example.com"}},
+		},
+		{ // invalid, with nothing changed
+			Sites:   []Site{site("a", false, "62", "a.example.com", ".b.example.com"), site("c", false, "60", "b.example.com", "*.b.example.com")},
+			Err:     `alias "*.b.example.com" of site "c" overlaps alias ".b.example.com" of site "a"`,
+			Aliases: map[string][]string{"a": {"a.example.com"}, "c": {"*.b.example.com", "b.example.com"}},
+		},
+		{ // remove aliases and stop on-demand site without connections
+			Sites:   []Site{site("a", false, "61"), site("c", true, "60", "b.example.com")},
+			Aliases: map[string][]string{"a": nil, "c": {"b.example.com"}},
+			Idle:    []string{"c"},
+		},
+		{ // failed site, with others still updated
+			Sites:   []Site{site("a", false, "61", "a.example.com"), {Name: "d", Cmd: "/nonexistent/command"}},
+			Err:     `error adding site "d": `,
+			Aliases: map[string][]string{"a": {"a.example.com"}},
+		},
+		{ // remove
+			Sites:   []Site{site("a", false, "61", "a.example.com")},
+			Aliases: map[string][]string{"a": {"a.example.com"}},
+		},
+	} {
+		pids := make(map[string]int)
+		for _, h := range p.Hosts() {
+			pids[h.Name()] = h.Status().PID
+		}
+		err := s.apply(&Config{Sites: test.Sites})
+		if test.Err == "" && err != nil {
+			t.Errorf("test %d: unexpected error: %s", n+1, err)
+		} else if test.Err != "" && (err == nil || !strings.HasPrefix(err.Error(), test.Err)) {
+			t.Errorf("test %d: expecting error %q, got %v", n+1, test.Err, err)
+		}
+		hosts := p.Hosts()
+		if len(hosts) != len(test.Aliases) {
+			t.Errorf("test %d: expecting %d hosts, got %d", n+1, len(test.Aliases), len(hosts))
+		}
+		for _, h := range hosts {
+			name := h.Name()
+			expected, ok := test.Aliases[name]
+			if !ok {
+				t.Errorf("test %d: unexpected host %q", n+1, name)
+				continue
+			}
+			aliases := h.Aliases()
+			slices.Sort(aliases)
+			if !slices.Equal(aliases, expected) {
+				t.Errorf("test %d: host %q: expecting aliases %q, got %q", n+1, name, expected, aliases)
+			}
+			status := h.Status()
+			if idle := slices.Contains(test.Idle, name); status.Idle != idle {
+				t.Errorf("test %d: host %q: expecting idle %v, got %v", n+1, name, idle, status.Idle)
+			} else if !idle && (!status.Running || !status.Ready) {
+				t.Errorf("test %d: host %q: expecting host to be running", n+1, name)
+			}
+			if pid, ok := pids[name]; ok && pid != 0 && !status.Idle {
+				if replaced := slices.Contains(test.Replaced, name); (pid != status.PID) != replaced {
+					t.Errorf("test %d: host %q: expecting replaced %v, got PID %d, was %d", n+1, name, replaced, status.PID, pid)
+				}
+			}
+		}
+		if h := p.Host("a"); h == nil || !p.IsDefault(h) {
+			t.Errorf("test %d: expecting site a to be the default", n+1)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package main // import "vimagination.zapto.org/webserver/webserverctl"
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+var socket = flag.String("s", "", "path to the admin socket of the running proxy")
+
+const usage = `usage: %s -s socket command [arguments]
+
+commands:
+	status                        show the status of all sites
+	hosts                         list sites and their aliases
+	restart site                  restart a site
+	drain site                    stop a site once its connections finish
+	alias add site alias...       add aliases to a site
+	alias remove site alias...    remove aliases from a site
+	default site                  set the default site
+	reload                        reload the proxy configuration
+`
+
+type hostStatus struct {
+	Name      string
+	Default   bool
+	Aliases   []string
+	PID       int
+	Running   bool
+	Ready     bool
+	Started   time.Time
+	Healthy   bool
+	Idle      bool
+	Restarts  int
+	Instances []instanceStatus
+	Usage     resourceUsage
+}
+
+type resourceUsage struct {
+	CPU    time.Duration
+	Memory int64
+	Pids   int
+	Files  int
+}
+
+func (u resourceUsage) String() string {
+	return fmt.Sprintf("%s\t%.1fM\t%d\t%d", u.CPU.Truncate(10*time.Millisecond), float64(u.Memory)/(1<<20), u.Pids, u.Files)
+}
+
+type instanceStatus struct {
+	PID         int
+	Running     bool
+	Ready       bool
+	Started     time.Time
+	Healthy     bool
+	Connections int64
+}
+
+func uptime(running bool, started time.Time) time.Duration {
+	if running {
+		return time.Since(started).Truncate(time.Second)
+	}
+	return 0
+}
+
+type errorResponse struct {
+	Error string
+}
+
+type client struct {
+	http.Client
+}
+
+func newClient(path string) *client {
+	return &client{
+		Client: http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", path)
+				},
+			},
+			Timeout: time.Minute,
+		},
+	}
+}
+
+// do sends a request to the admin API, decoding any response into v
+func (c *client) do(method, path string, body, v interface{}) error {
+	var r io.Reader
+	if body != nil {
+		buf, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(buf)
+	}
+	req, err := http.NewRequest(method, "http://proxy/"+path, r)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		var e errorResponse
+		if err = json.NewDecoder(resp.Body).Decode(&e); err != nil || e.Error == "" {
+			return errors.New(resp.Status)
+		}
+		return errors.New(e.Error)
+	}
+	if v != nil {
+		return json.NewDecoder(resp.Body).Decode(v)
+	}
+	return nil
+}
+
+// status writes a table of the status of all sites to out, or only their
+// aliases if hostsOnly is set
+func (c *client) status(out io.Writer, hostsOnly bool) error {
+	var statuses []hostStatus
+	path := "status"
+	if hostsOnly {
+		path = "hosts"
+	}
+	if err := c.do(http.MethodGet, path, nil, &statuses); err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	if hostsOnly {
+		fmt.Fprintln(w, "SITE\tDEFAULT\tALIASES")
+		for _, s := range statuses {
+			fmt.Fprintf(w, "%s\t%t\t%s\n", s.Name, s.Default, strings.Join(s.Aliases, ","))
+		}
+	} else {
+		fmt.Fprintln(w, "SITE\tPID\tRUNNING\tREADY\tHEALTHY\tRESTARTS\tUPTIME\tCONNS\tCPU\tMEM\tPIDS\tFILES")
+		for _, s := range statuses {
+			if s.Idle {
+				fmt.Fprintf(w, "%s\t\t\t\t%t\t%d\tidle\t\t%s\n", s.Name, s.Healthy, s.Restarts, s.Usage)
+				continue
+			}
+			if len(s.Instances) <= 1 {
+				var conns int64
+				if len(s.Instances) == 1 {
+					conns = s.Instances[0].Connections
+				}
+				fmt.Fprintf(w, "%s\t%d\t%t\t%t\t%t\t%d\t%s\t%d\t%s\n", s.Name, s.PID, s.Running, s.Ready, s.Healthy, s.Restarts, uptime(s.Running, s.Started), conns, s.Usage)
+				continue
+			}
+			fmt.Fprintf(w, "%s\t\t\t\t%t\t%d\t\t\t%s\n", s.Name, s.Healthy, s.Restarts, s.Usage)
+			for n, i := range s.Instances {
+				fmt.Fprintf(w, "  #%d\t%d\t%t\t%t\t%t\t\t%s\t%d\n", n, i.PID, i.Running, i.Ready, i.Healthy, uptime(i.Running, i.Started), i.Connections)
+			}
+		}
+	}
+	return w.Flush()
+}
+
+func run(c *client, out io.Writer, args []string) error {
+	switch args[0] {
+	case "status":
+		return c.status(out, false)
+	case "hosts":
+		return c.status(out, true)
+	case "restart", "drain":
+		if len(args) != 2 {
+			return ErrUsage
+		}
+		return c.do(http.MethodPost, "hosts/"+args[1]+"/"+args[0], nil, nil)
+	case "alias":
+		if len(args) < 4 {
+			return ErrUsage
+		}
+		method := http.MethodPost
+		switch args[1] {
+		case "add":
+		case "remove":
+			method = http.MethodDelete
+		default:
+			return ErrUsage
+		}
+		return c.do(method, "hosts/"+args[2]+"/aliases", struct{ Aliases []string }{args[3:]}, nil)
+	case "default":
+		if len(args) != 2 {
+			return ErrUsage
+		}
+		return c.do(http.MethodPost, "default", struct{ Name string }{args[1]}, nil)
+	case "reload":
+		return c.do(http.MethodPost, "reload", nil, nil)
+	}
+	return ErrUsage
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, usage, os.Args[0])
+	}
+	flag.Parse()
+	if *socket == "" || flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err := run(newClient(*socket), os.Stdout, flag.Args()); err == ErrUsage {
+		flag.Usage()
+		os.Exit(2)
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// Errors
+var (
+	ErrUsage = errors.New("invalid usage")
+)
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type request struct {
+	Method, Path, Body string
+}
+
+func newTestServer(t *testing.T) (*client, *[]request) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "admin.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("unexpected error listening: %s", err)
+	}
+	var requests []request
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests = append(requests, request{r.Method, r.URL.Path, string(body)})
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/hosts":
+			io.WriteString(w, `[{"Name":"a","Default":true,"Aliases":["a.example.com","www.example.com"]},{"Name":"b","Aliases":["b.example.com"]}]`)
+		case "/status":
+			io.WriteString(w, `[{"Name":"a","PID":100,"Healthy":true,"Restarts":1,"Instances":[{"PID":100,"Ready":true,"Healthy":true,"Connections":3}],"Usage":{"Memory":1048576,"Pids":2,"Files":5}},{"Name":"b","Healthy":true,"Idle":true},{"Name":"c","Healthy":false,"Instances":[{"PID":200,"Healthy":true,"Connections":1},{"PID":201}]}]`)
+		case "/hosts/missing/restart":
+			w.WriteHeader(http.StatusNotFound)
+			io.WriteString(w, `{"Error":"unknown site"}`)
+		case "/reload":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	s.Listener.Close()
+	s.Listener = l
+	s.Start()
+	t.Cleanup(s.Close)
+	return newClient(path), &requests
+}
+
+func TestRun(t *testing.T) {
+	c, requests := newTestServer(t)
+	for n, test := range [...]struct {
+		Args    []string
+		Request *request
+		Output  string
+		Err     string
+	}{
+		{
+			Args:    []string{"hosts"},
+			Request: &request{http.MethodGet, "/hosts", ""},
+			Output:  "SITE  DEFAULT  ALIASES\na     true     a.example.com,www.example.com\nb     false    b.example.com\n",
+		},
+		{
+			Args:    []string{"status"},
+			Request: &request{http.MethodGet, "/status", ""},
+			Output: "SITE  PID  RUNNING  READY  HEALTHY  RESTARTS  UPTIME  CONNS  CPU  MEM   PIDS  FILES\n" +
+				"a     100  false    false  true     1         0s      3      0s   1.0M  2     5\n" +
+				"b                          true     0         idle           0s   0.0M  0     0\n" +
+				"c                          false    0                        0s   0.0M  0     0\n" +
+				"  #0  200  false    false  true               0s      1\n" +
+				"  #1  201  false    false  false              0s      0\n",
+		},
+		{
+			Args:    []string{"restart", "a"},
+			Request: &request{http.MethodPost, "/hosts/a/restart", ""},
+		},
+		{
+			Args:    []string{"drain", "b"},
+			Request: &request{http.MethodPost, "/hosts/b/drain", ""},
+		},
+		{
+			Args:    []string{"restart", "missing"},
+			Request: &request{http.MethodPost, "/hosts/missing/restart", ""},
+			Err:     "unknown site",
+		},
+		{
+			Args:    []string{"alias", "add", "a", "x.example.com", "y.example.com"},
+			Request: &request{http.MethodPost, "/hosts/a/aliases", `{"Aliases":["x.example.com","y.example.com"]}`},
+		},
+		{
+			Args:    []string{"alias", "remove", "a", "x.example.com"},
+			Request: &request{http.MethodDelete, "/hosts/a/aliases", `{"Aliases":["x.example.com"]}`},
+		},
+		{
+			Args:    []string{"default", "b"},
+			Request: &request{http.MethodPost, "/default", `{"Name":"b"}`},
+		},
+		{
+			Args:    []string{"reload"},
+			Request: &request{http.MethodPost, "/reload", ""},
+			Err:     "500 Internal Server Error",
+		},
+		{
+			Args: []string{"restart"},
+			Err:  ErrUsage.Error(),
+		},
+		{
+			Args: []string{"alias", "add", "a"},
+			Err:  ErrUsage.Error(),
+		},
+		{
+			Args: []string{"alias", "rename", "a", "x.example.com"},
+			Err:  ErrUsage.Error(),
+		},
+		{
+			Args: []string{"default"},
+			Err:  ErrUsage.Error(),
+		},
+		{
+			Args: []string{"unknown"},
+			Err:  ErrUsage.Error(),
+		},
+	} {
+		*requests = (*requests)[:0]
+		var out strings.Builder
+		err := run(c, &out, test.Args)
+		if test.Err == "" && err != nil {
+			t.Errorf("test %d: unexpected error: %s", n+1, err)
+		} else if test.Err != "" && (err == nil || err.Error() != test.Err) {
+			t.Errorf("test %d: expecting error %q, got %v", n+1, test.Err, err)
+		}
+		if test.Request == nil {
+			if len(*requests) != 0 {
+				t.Errorf("test %d: expecting no requests, got %v", n+1, *requests)
+			}
+		} else if len(*requests) != 1 {
+			t.Errorf("test %d: expecting 1 request, got %d", n+1, len(*requests))
+		} else if r := (*requests)[0]; r.Method != test.Request.Method || r.Path != test.Request.Path || strings.TrimSpace(r.Body) != test.Request.Body {
+			t.Errorf("test %d: expecting request %v, got %v", n+1, *test.Request, r)
+		}
+		if got := out.String(); got != test.Output {
+			t.Errorf("test %d: expecting output:\n%s\ngot:\n%s", n+1, test.Output, got)
+		}
+	}
+}